@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// amneziaKeys lists the AmneziaWG obfuscation settings in the order they
+// are written to the [Interface] section.
+var amneziaKeys = []string{"Jc", "Jmin", "Jmax", "S1", "S2", "H1", "H2", "H3", "H4"}
+
+// amneziaDefaults only adds junk packets. S1/S2 and H1-H4 keep the values
+// that stay compatible with the standard WireGuard servers NordVPN runs.
+var amneziaDefaults = map[string]uint64{
+	"Jc": 4, "Jmin": 40, "Jmax": 70,
+	"S1": 0, "S2": 0,
+	"H1": 1, "H2": 2, "H3": 3, "H4": 4,
+}
+
+// parseAmnezia merges "Key=Value" overrides like "Jc=5,Jmax=100" into the
+// defaults and checks the ranges AmneziaWG accepts.
+func parseAmnezia(overrides string) (map[string]uint64, error) {
+	params := make(map[string]uint64, len(amneziaDefaults))
+	for k, v := range amneziaDefaults {
+		params[k] = v
+	}
+
+	for _, pair := range strings.Split(overrides, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if _, known := params[key]; !ok || !known {
+			return nil, fmt.Errorf("invalid AmneziaWG setting %q", pair)
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AmneziaWG value for %s: %q", key, value)
+		}
+		params[key] = n
+	}
+
+	switch {
+	case params["Jc"] < 1 || params["Jc"] > 128:
+		return nil, fmt.Errorf("AmneziaWG Jc must be between 1 and 128")
+	case params["Jmin"] > params["Jmax"]:
+		return nil, fmt.Errorf("AmneziaWG Jmin must not be greater than Jmax")
+	case params["Jmax"] > 1280:
+		return nil, fmt.Errorf("AmneziaWG Jmax must be at most 1280")
+	case params["S1"] > 1132:
+		return nil, fmt.Errorf("AmneziaWG S1 must be at most 1132")
+	case params["S2"] > 1188:
+		return nil, fmt.Errorf("AmneziaWG S2 must be at most 1188")
+	case params["S1"]+56 == params["S2"]:
+		return nil, fmt.Errorf("AmneziaWG S1 + 56 must not equal S2")
+	}
+	seen := make(map[uint64]bool)
+	for _, key := range []string{"H1", "H2", "H3", "H4"} {
+		if seen[params[key]] {
+			return nil, fmt.Errorf("AmneziaWG H1-H4 must all be different")
+		}
+		seen[params[key]] = true
+	}
+	return params, nil
+}
+
+// amneziaLines returns the [Interface] lines for the given settings.
+func amneziaLines(params map[string]uint64) []configLine {
+	lines := make([]configLine, 0, len(amneziaKeys))
+	for _, key := range amneziaKeys {
+		lines = append(lines, configLine{key, strconv.FormatUint(params[key], 10)})
+	}
+	return lines
+}
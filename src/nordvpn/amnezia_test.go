@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAmnezia(t *testing.T) {
+	tests := []struct {
+		overrides string
+		wantErr   bool
+		check     map[string]uint64
+	}{
+		{"", false, map[string]uint64{"Jc": 4, "Jmin": 40, "Jmax": 70, "H4": 4}},
+		{"Jc=5, Jmax=100", false, map[string]uint64{"Jc": 5, "Jmin": 40, "Jmax": 100}},
+		{"S1=10,S2=20", false, map[string]uint64{"S1": 10, "S2": 20}},
+		{"Jc=0", true, nil},
+		{"Jc=129", true, nil},
+		{"Jmin=80", true, nil}, // above the default Jmax
+		{"Jmax=1281", true, nil},
+		{"S1=1133", true, nil},
+		{"S2=1189", true, nil},
+		{"S1=10,S2=66", true, nil},
+		{"H1=2", true, nil},
+		{"Jc=-1", true, nil},
+		{"Jc=abc", true, nil},
+		{"Foo=1", true, nil},
+		{"Jc", true, nil},
+	}
+	for _, tt := range tests {
+		params, err := parseAmnezia(tt.overrides)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseAmnezia(%q) error = %v, want error %v", tt.overrides, err, tt.wantErr)
+			continue
+		}
+		for key, want := range tt.check {
+			if params[key] != want {
+				t.Errorf("parseAmnezia(%q)[%s] = %d, want %d", tt.overrides, key, params[key], want)
+			}
+		}
+	}
+}
+
+func TestAmneziaLinesInConfig(t *testing.T) {
+	params, err := parseAmnezia("Jc=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, err := decodeServers(strings.NewReader(`[{"name":"A","station":"1.1.1.1"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	amneziaSettings = nil
+	plain := buildConfig("PRIV=", servers[0])
+	amneziaSettings = params
+	t.Cleanup(func() { amneziaSettings = nil })
+	config := buildConfig("PRIV=", servers[0])
+
+	iface, peer, _ := strings.Cut(config, "[Peer]")
+	want := "Jc = 5\nJmin = 40\nJmax = 70\nS1 = 0\nS2 = 0\nH1 = 1\nH2 = 2\nH3 = 3\nH4 = 4\n"
+	if !strings.HasSuffix(strings.TrimRight(iface, "\n")+"\n", want) {
+		t.Errorf("[Interface] doesn't end with the AmneziaWG lines in order:\n%s", iface)
+	}
+	if strings.Contains(peer, "Jc") || strings.Contains(plain, "Jc") {
+		t.Errorf("AmneziaWG lines outside [Interface] or without -amnezia:\n%s", config)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// apiClient sends all HTTP requests; setupClient configures its transport.
+var apiClient = http.DefaultClient
+
+// setupClient applies the -proxy, -ca-file and -insecure settings. Without
+// -proxy the HTTP_PROXY and HTTPS_PROXY environment variables are used, as by
+// any Go program.
+func setupClient() error {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if *proxyURL != "" {
+		u, err := url.Parse(*proxyURL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid -proxy %q: must be a URL like http://host:port", *proxyURL)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return fmt.Errorf("invalid -proxy %q: scheme must be http, https or socks5", *proxyURL)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+
+	// Networks with TLS interception need their own CA trusted on top of the system roots
+	if *caFile != "" || *insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: *insecure}
+	}
+	if *caFile != "" {
+		pem, err := os.ReadFile(*caFile)
+		if err != nil {
+			return fmt.Errorf("reading -ca-file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("invalid -ca-file %q: no PEM certificates found", *caFile)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	if *insecure {
+		fmt.Fprintln(os.Stderr, "WARNING: -insecure disables TLS certificate verification. Your token and private key can be intercepted.")
+	}
+	apiClient = &http.Client{Transport: transport}
+	return nil
+}
+
+// apiContext returns a context for one API request, retries included, that
+// ends after -timeout.
+func apiContext(parent context.Context) (context.Context, context.CancelFunc) {
+	if *apiTimeout > 0 {
+		return context.WithTimeout(parent, *apiTimeout)
+	}
+	return context.WithCancel(parent)
+}
+
+// doWithRetry sends req, retrying network errors, 429 and 5xx responses with
+// exponential backoff and jitter. Other responses (e.g. 401) are returned as is.
+func doWithRetry(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := apiClient.Do(req)
+		retryable := err != nil || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		if !retryable || attempt >= *apiRetries {
+			return resp, err
+		}
+
+		delay := *apiRetryDelay << attempt
+		delay += time.Duration(rand.Int63n(int64(delay)/2 + 1))
+		if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) < delay {
+			return resp, err
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// locationURL answers with the caller's location; tests point it at a local server.
+var locationURL = "https://ipinfo.io/json"
+
+func getLocation(ctx context.Context) (Location, error) {
+	var loc Location
+	ctx, cancel := apiContext(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", locationURL, nil)
+	if err != nil {
+		return loc, err
+	}
+	resp, err := doWithRetry(req)
+	if err != nil {
+		return loc, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return loc, fmt.Errorf("location lookup failed: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&loc); err != nil {
+		return loc, err
+	}
+
+	return loc, nil
+}
+
+// apiBase is the NordVPN API root; tests point it at a local server.
+var apiBase = "https://api.nordvpn.com"
+
+// getServers fetches the servers of every technology in publicKeyTechs and
+// merges them by name, keeping the entry of the preferred technology.
+func getServers(ctx context.Context) ([]Server, error) {
+	var servers []Server
+	seen := make(map[string]bool)
+	for _, tech := range publicKeyTechs {
+		list, err := getServersWith(ctx, tech)
+		if err != nil {
+			return nil, err
+		}
+		for _, server := range list {
+			if !seen[server.Name] {
+				seen[server.Name] = true
+				servers = append(servers, server)
+			}
+		}
+	}
+	return servers, nil
+}
+
+// getServersWith fetches the servers offering the given technology.
+func getServersWith(ctx context.Context, tech string) ([]Server, error) {
+	ctx, cancel := apiContext(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", apiBase+"/v1/servers?limit=7000&filters[servers_technologies][identifier]="+url.QueryEscape(tech), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := doWithRetry(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("servers request failed: %s", resp.Status)
+	}
+
+	body := &countingReader{r: resp.Body}
+	servers, err := decodeServers(body)
+	if err != nil {
+		if resp.ContentLength > 0 && body.n < resp.ContentLength {
+			return nil, fmt.Errorf("server list truncated: got %d of %d bytes", body.n, resp.ContentLength)
+		}
+		return nil, err
+	}
+
+	return servers, nil
+}
+
+// decodeServers decodes the server array one element at a time, so the
+// whole multi-megabyte body never has to be buffered at once.
+func decodeServers(r io.Reader) ([]Server, error) {
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if tok == nil {
+		return nil, nil
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return nil, fmt.Errorf("server list is not a JSON array")
+	}
+
+	var servers []Server
+	for dec.More() {
+		var server Server
+		if err := dec.Decode(&server); err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return servers, nil
+}
+
+// Group is a server specialty group such as "P2P" or "Onion Over VPN".
+type Group struct {
+	ID         int    `json:"id"`
+	Title      string `json:"title"`
+	Identifier string `json:"identifier"`
+}
+
+// getGroups fetches the specialty groups that servers refer to by id.
+func getGroups(ctx context.Context) ([]Group, error) {
+	ctx, cancel := apiContext(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", apiBase+"/v1/servers/groups", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := doWithRetry(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("groups request failed: %s", resp.Status)
+	}
+	var groups []Group
+	if err := json.NewDecoder(resp.Body).Decode(&groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type Credentials struct {
+	NordlynxPrivateKey string `json:"nordlynx_private_key"`
+}
+
+// Errors from getPrivateKey, telling a bad token apart from an API outage.
+var (
+	// errMalformedKey is returned when the credentials API answers with a
+	// private key that isn't a valid WireGuard key.
+	errMalformedKey = errors.New("malformed key from upstream")
+	// errUnauthorized is returned when the token is rejected.
+	errUnauthorized = errors.New("token expired or invalid")
+	// errUpstream wraps network errors and 5xx answers, worth retrying.
+	errUpstream = errors.New("NordVPN API unreachable")
+)
+
+func getPrivateKey(ctx context.Context, token string) (string, error) {
+	ctx, cancel := apiContext(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", apiBase+"/v1/users/services/credentials", nil)
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth("token", token)
+
+	resp, err := doWithRetry(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errUpstream, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return "", errUnauthorized
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return "", fmt.Errorf("%w: credentials request failed: %s", errUpstream, resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("credentials request failed: %s", resp.Status)
+	}
+
+	var data Credentials
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return "", err
+	}
+	if !isValidWgKey(data.NordlynxPrivateKey) {
+		return "", errMalformedKey
+	}
+
+	return data.NordlynxPrivateKey, nil
+}
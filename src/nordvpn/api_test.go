@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveAPI points apiBase at handler for the duration of the test.
+func serveAPI(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	old := apiBase
+	apiBase = srv.URL
+	t.Cleanup(func() { apiBase = old })
+}
+
+// serveLocation points locationURL at handler for the duration of the test.
+func serveLocation(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	old := locationURL
+	locationURL = srv.URL
+	t.Cleanup(func() { locationURL = old })
+}
+
+func TestGetServersMergesNordlynx(t *testing.T) {
+	serveAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("filters[servers_technologies][identifier]") {
+		case "wireguard_udp":
+			w.Write([]byte(`[{"name":"Both #1","station":"1.1.1.1","technologies":[{"identifier":"wireguard_udp","metadata":[{"name":"public_key","value":"WG="}]}]}]`))
+		case "nordlynx":
+			w.Write([]byte(`[{"name":"Both #1","station":"1.1.1.1","technologies":[{"identifier":"nordlynx","metadata":[{"name":"public_key","value":"NL="}]}]},
+				{"name":"Lynx #2","station":"2.2.2.2","locations":[{"country":{"name":"Germany","code":"DE","city":{"name":"Berlin"}}}],
+				 "technologies":[{"identifier":"nordlynx","metadata":[{"name":"public_key","value":"LYNX="}]}]}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	servers, err := getServers(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 2 {
+		t.Fatalf("got %d servers, want 2", len(servers))
+	}
+	if key := findPublicKey(servers[0]); key != "WG=" {
+		t.Errorf("merged server key = %q, want the wireguard_udp key", key)
+	}
+	if key := findPublicKey(servers[1]); key != "LYNX=" {
+		t.Errorf("nordlynx-only server key = %q, want LYNX=", key)
+	}
+	if config := buildConfig("PRIV=", servers[1]); !strings.Contains(config, "PublicKey = LYNX=\n") {
+		t.Errorf("nordlynx-only server missing from config:\n%s", config)
+	}
+}
+
+func TestFindPublicKeyPrefersWireguardUDP(t *testing.T) {
+	servers, err := decodeServers(strings.NewReader(`[{"technologies":[
+		{"identifier":"nordlynx","metadata":[{"name":"public_key","value":"NL="}]},
+		{"identifier":"wireguard_udp","metadata":[{"name":"public_key","value":"WG="}]}]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := findPublicKey(servers[0]); key != "WG=" {
+		t.Errorf("findPublicKey = %q, want WG=", key)
+	}
+}
+
+func TestDoWithRetry(t *testing.T) {
+	oldRetries, oldDelay := *apiRetries, *apiRetryDelay
+	*apiRetries, *apiRetryDelay = 3, time.Millisecond
+	t.Cleanup(func() { *apiRetries, *apiRetryDelay = oldRetries, oldDelay })
+
+	tests := []struct {
+		name     string
+		statuses []int
+		want     int
+		calls    int
+	}{
+		{"succeeds after failing twice", []int{503, 500, 200}, 200, 3},
+		{"retries 429", []int{429, 200}, 200, 2},
+		{"doesn't retry 401", []int{401, 200}, 401, 1},
+		{"gives up after -retries", []int{503, 503, 503, 503, 503}, 503, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.statuses[calls])
+				calls++
+			}))
+			defer srv.Close()
+
+			req, _ := http.NewRequest("GET", srv.URL, nil)
+			resp, err := doWithRetry(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want || calls != tt.calls {
+				t.Errorf("got %d after %d calls, want %d after %d", resp.StatusCode, calls, tt.want, tt.calls)
+			}
+		})
+	}
+}
+
+func TestDoWithRetryStopsAtDeadline(t *testing.T) {
+	oldDelay := *apiRetryDelay
+	*apiRetryDelay = time.Hour
+	t.Cleanup(func() { *apiRetryDelay = oldDelay })
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+	start := time.Now()
+	resp, err := doWithRetry(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("waited %v for a retry that couldn't finish before the deadline", time.Since(start))
+	}
+}
+
+// serverFixture returns a server list body like the API's, n servers long.
+func serverFixture(n int) []byte {
+	var b strings.Builder
+	b.WriteString("[")
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, `{"name":"Server #%d","hostname":"s%d.nordvpn.com","station":"10.0.%d.%d","load":%d,"status":"online",`+
+			`"technologies":[{"identifier":"wireguard_udp","metadata":[{"name":"public_key","value":"KEY%d="}]}],`+
+			`"locations":[{"country":{"name":"São Tomé","code":"ST","city":{"name":"City %d"}},"latitude":%d.5,"longitude":-%d.25}],`+
+			`"groups":[{"id":%d,"title":"P2P","identifier":"legacy_p2p"}],`+
+			`"specifications":[{"identifier":"virtual_location","values":[{"value":"%t"}]}]}`,
+			i, i, i/256, i%256, i%100, i, i%40, i%90, i%180, i%5, i%2 == 0)
+	}
+	b.WriteString("]")
+	return []byte(b.String())
+}
+
+func TestDecodeServersMatchesUnmarshal(t *testing.T) {
+	body := serverFixture(500)
+	streamed, err := decodeServers(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var whole []Server
+	if err := json.Unmarshal(body, &whole); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := json.Marshal(streamed)
+	want, _ := json.Marshal(whole)
+	if !bytes.Equal(got, want) {
+		t.Error("streamed decoding differs from json.Unmarshal")
+	}
+}
+
+func TestGetServersReportsTruncation(t *testing.T) {
+	setFlags(t, "-retries", "0")
+	body := serverFixture(100)
+	serveAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body[:len(body)/2])
+	})
+
+	_, err := getServersWith(context.Background(), "wireguard_udp")
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("truncated: got %d of %d bytes", len(body)/2, len(body))) {
+		t.Errorf("getServersWith on a cut off body = %v, want a truncation error", err)
+	}
+}
+
+func TestDecodeServersErrors(t *testing.T) {
+	for _, body := range []string{``, `{}`, `[{"name":"A"}`, `[{"name":"A"},`} {
+		if _, err := decodeServers(strings.NewReader(body)); err == nil {
+			t.Errorf("decodeServers(%q) succeeded, want an error", body)
+		}
+	}
+	if servers, err := decodeServers(strings.NewReader(`null`)); err != nil || servers != nil {
+		t.Errorf("decodeServers(null) = %v, %v; want no servers", servers, err)
+	}
+}
+
+func BenchmarkDecodeServers(b *testing.B) {
+	body := serverFixture(16384)
+	b.Run("stream", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := decodeServers(bytes.NewReader(body)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("whole", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var servers []Server
+			if err := json.NewDecoder(bytes.NewReader(body)).Decode(&servers); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// restoreClient puts back the HTTP client that setupClient replaces.
+func restoreClient(t *testing.T) {
+	old := apiClient
+	t.Cleanup(func() { apiClient = old })
+}
+
+func TestSetupClientProxy(t *testing.T) {
+	restoreClient(t)
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.Write([]byte("[]"))
+	}))
+	defer proxy.Close()
+
+	setFlags(t, "-proxy", proxy.URL)
+	if err := setupClient(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := apiClient.Get("http://api.nordvpn.invalid/v1/servers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if proxied != "http://api.nordvpn.invalid/v1/servers" {
+		t.Errorf("proxy saw %q, want the API request", proxied)
+	}
+
+	for _, bad := range []string{"ftp://proxy:21", "proxy:8080", "http://"} {
+		setFlags(t, "-proxy", bad)
+		if err := setupClient(); err == nil {
+			t.Errorf("setupClient accepted -proxy %q", bad)
+		}
+	}
+}
+
+func TestSetupClientCAFile(t *testing.T) {
+	restoreClient(t)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	// The rejected handshake is expected, keep it out of the test output
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	setFlags(t)
+	if err := setupClient(); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := apiClient.Get(srv.URL); err == nil {
+		resp.Body.Close()
+		t.Fatal("request to a server with an untrusted certificate succeeded")
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(block), 0644); err != nil {
+		t.Fatal(err)
+	}
+	setFlags(t, "-ca-file", caFile)
+	if err := setupClient(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := apiClient.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("request with -ca-file failed: %v", err)
+	}
+	resp.Body.Close()
+
+	setFlags(t, "-ca-file", filepath.Join(t.TempDir(), "missing.pem"))
+	if err := setupClient(); err == nil {
+		t.Error("setupClient accepted a missing -ca-file")
+	}
+}
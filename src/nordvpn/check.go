@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// runCheck implements the "check [flags] <dir>" subcommand. It reports
+// saved configs, wg-quick or NetworkManager keyfiles, whose server no
+// longer exists or whose public key has changed, and exits with status 1
+// if any were found.
+func runCheck(args []string) {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: check [flags] <dir>")
+		flags.PrintDefaults()
+	}
+	for _, name := range apiFlags {
+		f := flag.CommandLine.Lookup(name)
+		flags.Var(f.Value, f.Name, f.Usage)
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err := validateAPIFlags(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := setupClient(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	var files []string
+	err := filepath.WalkDir(flags.Arg(0), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && (strings.HasSuffix(path, ".conf") || strings.HasSuffix(path, ".nmconnection")) {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	sort.Strings(files)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	fmt.Println("Getting servers...")
+	servers, err := getServers(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to get servers:", err)
+		os.Exit(1)
+	}
+
+	byHost := indexServers(servers)
+	stale := 0
+	for _, file := range files {
+		fields, err := readConfigFields(file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			continue
+		}
+		if problem := staleReason(byHost, fields); problem != "" {
+			fmt.Printf("%s: %s\n", file, problem)
+			stale++
+		}
+	}
+
+	fmt.Printf("Checked %d configs, %d out of date.\n", len(files), stale)
+	if stale > 0 {
+		os.Exit(1)
+	}
+}
+
+// indexServers maps the ways a config may point at a server to it: the
+// station IPs, the hostname and, for -endpoint-suffix, the short hostname.
+func indexServers(servers []Server) map[string]Server {
+	byHost := make(map[string]Server)
+	for _, server := range servers {
+		byHost[server.Station] = server
+		if server.StationV6 != "" {
+			byHost[strings.ToLower(server.StationV6)] = server
+		}
+		if server.Hostname != "" {
+			hostname := strings.ToLower(server.Hostname)
+			short, _, _ := strings.Cut(hostname, ".")
+			byHost[hostname] = server
+			byHost[short] = server
+		}
+	}
+	return byHost
+}
+
+// staleReason explains why a saved config no longer matches its server,
+// or returns "" if it is up to date.
+func staleReason(byHost map[string]Server, fields map[string]string) string {
+	host, _, err := net.SplitHostPort(fields["Endpoint"])
+	if err != nil {
+		return "no usable Endpoint"
+	}
+	host = strings.ToLower(host)
+	server, ok := byHost[host]
+	if !ok && net.ParseIP(host) == nil {
+		short, _, _ := strings.Cut(host, ".")
+		server, ok = byHost[short]
+	}
+	switch {
+	case !ok:
+		return "server " + host + " no longer exists"
+	case findPublicKey(server) != fields["PublicKey"]:
+		return "public key of " + server.Name + " has changed"
+	}
+	return ""
+}
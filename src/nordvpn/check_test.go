@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestStaleReason(t *testing.T) {
+	byHost := indexServers(testServers(t, `[{"name":"Germany #1","hostname":"de1.nordvpn.com","station":"1.2.3.4","ipv6_station":"2a00::1",
+		"technologies":[{"identifier":"wireguard_udp","metadata":[{"name":"public_key","value":"PUB="}]}]}]`))
+
+	tests := []struct {
+		endpoint, publicKey string
+		want                string
+	}{
+		{"1.2.3.4:51820", "PUB=", ""},
+		{"[2a00::1]:51820", "PUB=", ""},
+		{"de1.nordvpn.com:51820", "PUB=", ""},
+		{"DE1.internal:51820", "PUB=", ""}, // -endpoint-suffix
+		{"1.2.3.4:51820", "OLD=", "public key of Germany #1 has changed"},
+		{"5.6.7.8:51820", "PUB=", "server 5.6.7.8 no longer exists"},
+		{"de2.nordvpn.com:51820", "PUB=", "server de2.nordvpn.com no longer exists"},
+		{"", "PUB=", "no usable Endpoint"},
+	}
+	for _, tt := range tests {
+		fields := map[string]string{"Endpoint": tt.endpoint, "PublicKey": tt.publicKey}
+		if got := staleReason(byHost, fields); got != tt.want {
+			t.Errorf("staleReason(%s, %s) = %q, want %q", tt.endpoint, tt.publicKey, got, tt.want)
+		}
+	}
+}
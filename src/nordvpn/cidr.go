@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/netip"
+)
+
+// lanPrefixes are the private (RFC 1918), unique local and link-local
+// ranges left out of AllowedIPs by -exclude-lan.
+var lanPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+}
+
+// subtractCIDRs returns the smallest set of prefixes covering base minus
+// exclude, in address order.
+func subtractCIDRs(base, exclude []netip.Prefix) []netip.Prefix {
+	var out []netip.Prefix
+	for _, p := range base {
+		out = appendSubtracted(out, p.Masked(), exclude)
+	}
+	return out
+}
+
+// appendSubtracted halves p until each half is either clear of exclude,
+// and appended, or entirely excluded.
+func appendSubtracted(out []netip.Prefix, p netip.Prefix, exclude []netip.Prefix) []netip.Prefix {
+	overlaps := false
+	for _, e := range exclude {
+		if !e.Overlaps(p) {
+			continue
+		}
+		if e.Bits() <= p.Bits() {
+			return out // p lies inside e
+		}
+		overlaps = true
+	}
+	if !overlaps {
+		return append(out, p)
+	}
+
+	lower := netip.PrefixFrom(p.Addr(), p.Bits()+1)
+	b := p.Addr().AsSlice()
+	b[p.Bits()/8] |= 0x80 >> (p.Bits() % 8)
+	addr, _ := netip.AddrFromSlice(b)
+	upper := netip.PrefixFrom(addr, p.Bits()+1)
+	out = appendSubtracted(out, lower, exclude)
+	return appendSubtracted(out, upper, exclude)
+}
+
+// excludeLAN removes the LAN ranges from the AllowedIPs in list. Entries
+// that don't parse are kept as they are.
+func excludeLAN(list []string) []string {
+	var out []string
+	for _, entry := range list {
+		p, err := netip.ParsePrefix(entry)
+		if err != nil {
+			out = append(out, entry)
+			continue
+		}
+		for _, q := range subtractCIDRs([]netip.Prefix{p}, lanPrefixes) {
+			out = append(out, q.String())
+		}
+	}
+	return out
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// allowedMinusLAN is the well-known AllowedIPs list for "0.0.0.0/0, ::/0
+// except private, unique local and link-local networks".
+const allowedMinusLAN = "0.0.0.0/5, 8.0.0.0/7, 11.0.0.0/8, 12.0.0.0/6, 16.0.0.0/4, 32.0.0.0/3, " +
+	"64.0.0.0/2, 128.0.0.0/3, 160.0.0.0/5, 168.0.0.0/8, 169.0.0.0/9, 169.128.0.0/10, " +
+	"169.192.0.0/11, 169.224.0.0/12, 169.240.0.0/13, 169.248.0.0/14, 169.252.0.0/15, " +
+	"169.255.0.0/16, 170.0.0.0/7, 172.0.0.0/12, 172.32.0.0/11, 172.64.0.0/10, 172.128.0.0/9, " +
+	"173.0.0.0/8, 174.0.0.0/7, 176.0.0.0/4, 192.0.0.0/9, 192.128.0.0/11, 192.160.0.0/13, " +
+	"192.169.0.0/16, 192.170.0.0/15, 192.172.0.0/14, 192.176.0.0/12, 192.192.0.0/10, " +
+	"193.0.0.0/8, 194.0.0.0/7, 196.0.0.0/6, 200.0.0.0/5, 208.0.0.0/4, 224.0.0.0/3, " +
+	"::/1, 8000::/2, c000::/3, e000::/4, f000::/5, f800::/6, fe00::/9, fec0::/10, ff00::/8"
+
+func TestExcludeLAN(t *testing.T) {
+	got := strings.Join(excludeLAN([]string{"0.0.0.0/0", "::/0"}), ", ")
+	if got != allowedMinusLAN {
+		t.Errorf("excludeLAN(0.0.0.0/0, ::/0) =\n%s\nwant\n%s", got, allowedMinusLAN)
+	}
+}
+
+func TestSubtractCIDRs(t *testing.T) {
+	tests := []struct {
+		base, exclude []string
+		want          []string
+	}{
+		{[]string{"10.0.0.0/8"}, []string{"10.0.0.0/8"}, nil},
+		{[]string{"10.0.0.0/8"}, []string{"0.0.0.0/0"}, nil},
+		{[]string{"10.1.0.0/16"}, []string{"192.168.0.0/16"}, []string{"10.1.0.0/16"}},
+		{[]string{"10.0.0.0/30"}, []string{"10.0.0.1/32"}, []string{"10.0.0.0/32", "10.0.0.2/31"}},
+		{[]string{"10.0.0.7/24"}, []string{"10.0.0.128/25"}, []string{"10.0.0.0/25"}},
+		{[]string{"2001:db8::/32"}, []string{"2001:db8:8000::/33"}, []string{"2001:db8::/33"}},
+	}
+	for _, tt := range tests {
+		got := subtractCIDRs(prefixes(t, tt.base), prefixes(t, tt.exclude))
+		var gotStr []string
+		for _, p := range got {
+			gotStr = append(gotStr, p.String())
+		}
+		if !slices.Equal(gotStr, tt.want) {
+			t.Errorf("subtractCIDRs(%v, %v) = %v, want %v", tt.base, tt.exclude, gotStr, tt.want)
+		}
+	}
+}
+
+func prefixes(t *testing.T, list []string) []netip.Prefix {
+	t.Helper()
+	var out []netip.Prefix
+	for _, s := range list {
+		out = append(out, netip.MustParsePrefix(s))
+	}
+	return out
+}
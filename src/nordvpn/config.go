@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// configLine is a "Key = Value" line of a WireGuard config.
+type configLine struct {
+	key, value string
+}
+
+// configLayout controls the key order of each section and how a config
+// starts, so output can match what picky import tools expect.
+type configLayout struct {
+	leadingNewline bool
+	iface          []string
+	peer           []string
+}
+
+var configLayouts = map[string]configLayout{
+	"standard": {
+		leadingNewline: true,
+		iface:          []string{"PrivateKey", "Address", "DNS"},
+		peer:           []string{"PublicKey", "AllowedIPs", "Endpoint", "PersistentKeepalive"},
+	},
+	"nordvpn": {
+		iface: []string{"Address", "PrivateKey", "DNS"},
+		peer:  []string{"PublicKey", "Endpoint", "AllowedIPs", "PersistentKeepalive"},
+	},
+}
+
+func buildConfig(privateKey string, server Server) string {
+	iface := []configLine{
+		{"PrivateKey", privateKey},
+		{"Address", strings.Join(addressList(), ", ")},
+	}
+	if dnsServers := dnsList(); len(dnsServers) > 0 {
+		iface = append(iface, configLine{"DNS", strings.Join(dnsServers, ", ")})
+	}
+	peer := []configLine{
+		{"PublicKey", findPublicKey(server)},
+		{"AllowedIPs", strings.Join(allowedIPList(server), ", ")},
+		{"Endpoint", endpointHost(server) + ":51820"},
+	}
+	if *keepalive > 0 {
+		peer = append(peer, configLine{"PersistentKeepalive", strconv.Itoa(*keepalive)})
+	}
+
+	layout := configLayouts[*compat]
+	iface = orderLines(iface, layout.iface)
+	if amneziaSettings != nil {
+		iface = append(iface, amneziaLines(amneziaSettings)...)
+	}
+	peer = orderLines(peer, layout.peer)
+
+	var b strings.Builder
+	b.WriteString(configComments(server))
+	if layout.leadingNewline {
+		b.WriteString("\n")
+	}
+	writeSection(&b, "Interface", iface)
+	b.WriteString("\n")
+	writeSection(&b, "Peer", peer)
+	return b.String()
+}
+
+// orderLines sorts lines into the given key order. Keys not in order keep
+// their relative position after the ordered ones.
+func orderLines(lines []configLine, order []string) []configLine {
+	sorted := make([]configLine, 0, len(lines))
+	for _, key := range order {
+		for _, line := range lines {
+			if line.key == key {
+				sorted = append(sorted, line)
+			}
+		}
+	}
+	for _, line := range lines {
+		if !slices.Contains(order, line.key) {
+			sorted = append(sorted, line)
+		}
+	}
+	return sorted
+}
+
+// configComments returns the -label and -annotate comment lines that start
+// every config.
+func configComments(server Server) string {
+	var b strings.Builder
+	if *label != "" {
+		b.WriteString("# label: " + *label + "\n")
+	}
+	if *annotate {
+		country := server.Locations[0].Country
+		fmt.Fprintf(&b, "# load: %d%%  distance: %.0fkm  %s/%s\n", server.Load, server.Distance, country.Name, country.City.Name)
+	}
+	return b.String()
+}
+
+func writeSection(b *strings.Builder, name string, lines []configLine) {
+	b.WriteString("[" + name + "]\n")
+	for _, line := range lines {
+		b.WriteString(line.key + " = " + line.value + "\n")
+	}
+}
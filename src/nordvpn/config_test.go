@@ -0,0 +1,147 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildConfigLayouts(t *testing.T) {
+	servers := testServers(t, `[{"name":"Germany #1","station":"10.0.0.1",
+		"technologies":[{"identifier":"wireguard_udp","metadata":[{"name":"public_key","value":"PUB="}]}]}]`)
+	tests := []struct {
+		compat string
+		want   string
+	}{
+		{"standard", `
+[Interface]
+PrivateKey = PRIV=
+Address = 10.5.0.2/16
+DNS = 103.86.96.100
+
+[Peer]
+PublicKey = PUB=
+AllowedIPs = 0.0.0.0/0, ::/0
+Endpoint = 10.0.0.1:51820
+PersistentKeepalive = 25
+`},
+		{"nordvpn", `[Interface]
+Address = 10.5.0.2/16
+PrivateKey = PRIV=
+DNS = 103.86.96.100
+
+[Peer]
+PublicKey = PUB=
+Endpoint = 10.0.0.1:51820
+AllowedIPs = 0.0.0.0/0, ::/0
+PersistentKeepalive = 25
+`},
+	}
+	for _, tt := range tests {
+		setFlags(t, "-compat", tt.compat)
+		if got := buildConfig("PRIV=", servers[0]); got != tt.want {
+			t.Errorf("-compat %s:\n%s\nwant:\n%s", tt.compat, got, tt.want)
+		}
+	}
+}
+
+func TestOrderLinesKeepsUnknownKeys(t *testing.T) {
+	lines := []configLine{{"Jc", "4"}, {"DNS", "1.1.1.1"}, {"PrivateKey", "PRIV="}, {"Jmin", "40"}}
+	got := orderLines(lines, []string{"PrivateKey", "Address", "DNS"})
+	want := []configLine{{"PrivateKey", "PRIV="}, {"DNS", "1.1.1.1"}, {"Jc", "4"}, {"Jmin", "40"}}
+	if len(got) != len(want) {
+		t.Fatalf("orderLines = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("orderLines = %v, want %v", got, want)
+			break
+		}
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	server := testServers(t, fixtureServers)[0]
+	tests := []struct {
+		keepalive, wgLine, nmLine string
+	}{
+		{"0", "", ""},
+		{"60", "PersistentKeepalive = 60\n", "persistent-keepalive=60\n"},
+	}
+	for _, tt := range tests {
+		setFlags(t, "-keepalive", tt.keepalive)
+		wg, nm := buildConfig("PRIV=", server), buildNMConfig("PRIV=", server)
+		if tt.wgLine == "" {
+			if strings.Contains(wg, "PersistentKeepalive") || strings.Contains(nm, "persistent-keepalive") {
+				t.Errorf("-keepalive 0 still writes a keepalive:\n%s\n%s", wg, nm)
+			}
+			continue
+		}
+		if !strings.Contains(wg, tt.wgLine) || !strings.Contains(nm, tt.nmLine) {
+			t.Errorf("-keepalive %s not written:\n%s\n%s", tt.keepalive, wg, nm)
+		}
+	}
+
+	for _, bad := range []string{"10", "121", "-1"} {
+		setFlags(t, "-keepalive", bad)
+		if err := validateFlags(); err == nil {
+			t.Errorf("-keepalive %s was accepted", bad)
+		}
+	}
+}
+
+func TestLabel(t *testing.T) {
+	server := testServers(t, fixtureServers)[0]
+	setFlags(t, "-label", "home router")
+	if err := validateFlags(); err != nil {
+		t.Fatal(err)
+	}
+	for _, config := range []string{buildConfig("PRIV=", server), buildNMConfig("PRIV=", server)} {
+		if !strings.HasPrefix(config, "# label: home router\n") {
+			t.Errorf("config doesn't start with the label:\n%s", config)
+		}
+	}
+
+	for _, bad := range []string{"two\nlines", "carriage\rreturn"} {
+		setFlags(t, "-label", bad)
+		if err := validateFlags(); err == nil {
+			t.Errorf("-label %q was accepted", bad)
+		}
+	}
+}
+
+func TestNoDNS(t *testing.T) {
+	server := testServers(t, fixtureServers)[0]
+	setFlags(t)
+	withDNS := buildConfig("PRIV=", server)
+	want := strings.Replace(withDNS, "DNS = 103.86.96.100\n", "", 1)
+	if want == withDNS {
+		t.Fatalf("default config has no DNS line:\n%s", withDNS)
+	}
+
+	for _, args := range [][]string{{"-dns", "none"}, {"-dns", " None "}, {"-no-dns"}} {
+		setFlags(t, args...)
+		if err := validateFlags(); err != nil {
+			t.Fatal(err)
+		}
+		if got := buildConfig("PRIV=", server); got != want {
+			t.Errorf("%v:\n%s\nwant:\n%s", args, got, want)
+		}
+		if nm := buildNMConfig("PRIV=", server); strings.Contains(nm, "dns=") {
+			t.Errorf("%v still writes DNS to the keyfile:\n%s", args, nm)
+		}
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	setFlags(t, "-annotate")
+	servers := testServers(t, fixtureServers)
+	sortServers(servers, true, 50.11, 8.68) // Frankfurt
+	berlin := servers[0]
+
+	want := "# load: 10%  distance: 423km  Germany/Berlin\n"
+	for _, config := range []string{buildConfig("PRIV=", berlin), buildNMConfig("PRIV=", berlin)} {
+		if !strings.HasPrefix(config, want) {
+			t.Errorf("config doesn't start with %q:\n%s", want, config)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// contentIndex remembers the first path written for each config content,
+// so -dedup can link identical configs instead of writing them again.
+type contentIndex struct {
+	mu    sync.Mutex
+	paths map[[sha256.Size]byte]string
+}
+
+// dedupIndex is nil without -dedup.
+var dedupIndex *contentIndex
+
+// lookup returns the path already written with content, if any.
+func (c *contentIndex) lookup(content string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	first, ok := c.paths[sha256.Sum256([]byte(content))]
+	return first, ok
+}
+
+// add records that path was written with content. The first path stays
+// the link target when identical configs are written at the same time.
+func (c *contentIndex) add(content, path string) {
+	if c == nil {
+		return
+	}
+	sum := sha256.Sum256([]byte(content))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.paths == nil {
+		c.paths = make(map[[sha256.Size]byte]string)
+	}
+	if _, ok := c.paths[sum]; !ok {
+		c.paths[sum] = path
+	}
+}
+
+// linkDuplicate points path at first with a relative symlink, replacing
+// whatever an earlier run left at path.
+func linkDuplicate(first, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	target, err := filepath.Rel(filepath.Dir(path), first)
+	if err != nil {
+		target = first
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(target, path)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDedupSkipsFailedWrites(t *testing.T) {
+	outDir = t.TempDir()
+	dedupIndex = &contentIndex{}
+	status = io.Discard
+	t.Cleanup(func() { outDir, dedupIndex, status = "", nil, os.Stdout })
+	servers, err := decodeServers(strings.NewReader(`[{"name":"A","station":"1.1.1.1"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A regular file where a directory is expected makes the first write fail
+	blocker := filepath.Join(outDir, "blocker")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	saveConfig("PRIV=", servers[0], filepath.Join(blocker, "a.conf"))
+	second := filepath.Join(outDir, "b.conf")
+	saveConfig("PRIV=", servers[0], second)
+	third := filepath.Join(outDir, "c.conf")
+	saveConfig("PRIV=", servers[0], third)
+
+	if fi, err := os.Lstat(second); err != nil || !fi.Mode().IsRegular() {
+		t.Fatalf("after a failed write the next identical config must be written, got %v, %v", fi, err)
+	}
+	if fi, err := os.Lstat(third); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("third identical config should link to the second, got %v, %v", fi, err)
+	}
+	if target, _ := os.Readlink(third); target != "b.conf" {
+		t.Errorf("link target = %q, want b.conf", target)
+	}
+}
+
+func TestDedupReplacesEarlierRun(t *testing.T) {
+	outDir = t.TempDir()
+	dedupIndex = &contentIndex{}
+	t.Cleanup(func() { outDir, dedupIndex = "", nil })
+	servers, err := decodeServers(strings.NewReader(`[{"name":"A","station":"1.1.1.1"},{"name":"B","station":"2.2.2.2"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An earlier run left a regular file where the duplicate goes
+	first, second := filepath.Join(outDir, "a.conf"), filepath.Join(outDir, "b.conf")
+	if err := os.WriteFile(second, []byte("old key"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	saveConfig("PRIV=", servers[0], first)
+	saveConfig("PRIV=", servers[0], second)
+	if fi, err := os.Lstat(second); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("file of the earlier run wasn't replaced by a link, got %v, %v", fi, err)
+	}
+
+	// Without -dedup the link is replaced, leaving its target alone
+	dedupIndex = nil
+	saveConfig("PRIV=", servers[1], second)
+	if fi, err := os.Lstat(second); err != nil || !fi.Mode().IsRegular() {
+		t.Fatalf("link of the earlier run wasn't replaced by a file, got %v, %v", fi, err)
+	}
+	if data, _ := os.ReadFile(first); !strings.Contains(string(data), "1.1.1.1") {
+		t.Errorf("writing over a link changed its target:\n%s", data)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// diffRun prints how servers differ from a previous run saved in oldDir:
+// servers that were added or removed, and changed keys or endpoints.
+func diffRun(w io.Writer, oldDir string, servers []Server) error {
+	data, err := os.ReadFile(filepath.Join(oldDir, "servers.json"))
+	if err != nil {
+		return err
+	}
+	var old map[string]map[string]struct {
+		Servers [][]interface{} `json:"servers"`
+	}
+	if err := json.Unmarshal(data, &old); err != nil {
+		return fmt.Errorf("reading %s: %v", filepath.Join(oldDir, "servers.json"), err)
+	}
+
+	// Map "country/city/name" to the server for both runs
+	oldNames := make(map[string]bool)
+	for country, cities := range old {
+		for city, info := range cities {
+			for _, entry := range info.Servers {
+				if len(entry) > 0 {
+					if name, ok := entry[0].(string); ok {
+						oldNames[country+"/"+city+"/"+name] = true
+					}
+				}
+			}
+		}
+	}
+	current := make(map[string]Server)
+	for _, server := range servers {
+		country, city := locationNames(server)
+		current[country+"/"+city+"/"+server.Name] = server
+	}
+
+	var lines []string
+	for key, server := range current {
+		if !oldNames[key] {
+			lines = append(lines, "+ "+key)
+			continue
+		}
+		// The previous run may have used either -format
+		country, city := locationNames(server)
+		base := filepath.Join(oldDir, "configs", country, city, cleanServerName(server.Name))
+		fields, err := readConfigFields(base + ".conf")
+		if os.IsNotExist(err) {
+			fields, err = readConfigFields(base + ".nmconnection")
+		}
+		if err != nil {
+			continue
+		}
+		if publicKey := findPublicKey(server); fields["PublicKey"] != publicKey {
+			lines = append(lines, fmt.Sprintf("~ %s: public key %s -> %s", key, fields["PublicKey"], publicKey))
+		}
+		if endpoint := endpointHost(server) + ":51820"; fields["Endpoint"] != endpoint {
+			lines = append(lines, fmt.Sprintf("~ %s: endpoint %s -> %s", key, fields["Endpoint"], endpoint))
+		}
+	}
+	for key := range oldNames {
+		if _, ok := current[key]; !ok {
+			lines = append(lines, "- "+key)
+		}
+	}
+
+	sort.Slice(lines, func(i, j int) bool {
+		return lines[i][2:] < lines[j][2:]
+	})
+	if len(lines) == 0 {
+		fmt.Fprintln(w, "No changes since", oldDir)
+		return nil
+	}
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+	return nil
+}
+
+// keyfileFields maps NetworkManager keyfile keys to their wg-quick names.
+var keyfileFields = map[string]string{
+	"private-key": "PrivateKey",
+	"endpoint":    "Endpoint",
+	"allowed-ips": "AllowedIPs",
+}
+
+// readConfigFields returns the "Key = Value" pairs of a WireGuard config.
+// NetworkManager keyfiles are read too, with the peer's public key taken
+// from its [wireguard-peer.<key>] section and keys given wg-quick names.
+func readConfigFields(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			if peer, ok := strings.CutPrefix(strings.TrimSuffix(line, "]"), "[wireguard-peer."); ok {
+				fields["PublicKey"] = peer
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || strings.HasPrefix(key, "#") {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		if name, ok := keyfileFields[key]; ok {
+			key = name
+		}
+		fields[key] = strings.TrimSpace(value)
+	}
+	return fields, scanner.Err()
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadConfigFieldsBothFormats(t *testing.T) {
+	servers, err := decodeServers(strings.NewReader(`[{"name":"Germany #1","station":"1.2.3.4",
+		"technologies":[{"identifier":"wireguard_udp","metadata":[{"name":"public_key","value":"PUB+/key="}]}],
+		"locations":[{"country":{"name":"Germany","code":"DE","city":{"name":"Berlin"}}}]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldFormat := *format
+	t.Cleanup(func() { *format = oldFormat })
+
+	dir := t.TempDir()
+	for _, f := range []string{"wgquick", "nm"} {
+		*format = f
+		file := filepath.Join(dir, "config"+configExt())
+		if err := os.WriteFile(file, []byte(renderConfig("PRIV+/key=", servers[0])), 0600); err != nil {
+			t.Fatal(err)
+		}
+		fields, err := readConfigFields(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fields["PublicKey"] != "PUB+/key=" || fields["Endpoint"] != "1.2.3.4:51820" || fields["PrivateKey"] != "PRIV+/key=" {
+			t.Errorf("-format %s: read %v", f, fields)
+		}
+	}
+}
+
+func TestDiffRun(t *testing.T) {
+	setFlags(t)
+	old := t.TempDir()
+	files := map[string]string{
+		"servers.json":                          `{"Germany":{"Berlin":{"servers":[["Germany #1",30],["Germany #2",10]]}},"France":{"Paris":{"servers":[["France #1",40]]}}}`,
+		"configs/Germany/Berlin/Germany_1.conf": "[Peer]\nPublicKey = OLD=\nEndpoint = 10.0.0.1:51820\n",
+		"configs/Germany/Berlin/Germany_2.conf": "[Peer]\nPublicKey = DE2=\nEndpoint = 10.0.9.9:51820\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(old, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// France #1 is gone and Germany #3 is new
+	servers := testServers(t, fixtureServers)[:3]
+
+	var out bytes.Buffer
+	if err := diffRun(&out, old, servers); err != nil {
+		t.Fatal(err)
+	}
+	want := `- France/Paris/France #1
+~ Germany/Berlin/Germany #1: public key OLD= -> DE1=
+~ Germany/Berlin/Germany #2: endpoint 10.0.9.9:51820 -> 10.0.0.2:51820
++ Germany/Frankfurt/Germany #3
+`
+	if out.String() != want {
+		t.Errorf("diffRun printed:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
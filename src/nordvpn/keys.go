@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// isValidWgKey reports whether key is a base64 encoded 32-byte WireGuard key.
+func isValidWgKey(key string) bool {
+	if len(key) != 44 {
+		return false
+	}
+	raw, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(raw) == 32
+}
+
+// generateKeyPair returns a new base64 encoded Curve25519 key pair, with
+// the private key clamped the same way as "wg genkey" does.
+func generateKeyPair() (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	raw[0] &= 248
+	raw[31] = (raw[31] & 127) | 64
+
+	private, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(private.Bytes()),
+		base64.StdEncoding.EncodeToString(private.PublicKey().Bytes()), nil
+}
+
+// runGenkey implements the "genkey" subcommand.
+func runGenkey() {
+	private, public, err := generateKeyPair()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println("PrivateKey =", private)
+	fmt.Println("PublicKey =", public)
+}
+
+// publicKeyOf derives the base64 public key of a base64 private key.
+func publicKeyOf(privateKey string) (string, error) {
+	if !isValidWgKey(privateKey) {
+		return "", fmt.Errorf("invalid private key: must be 32 bytes of base64")
+	}
+	raw, _ := base64.StdEncoding.DecodeString(privateKey)
+	private, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(private.PublicKey().Bytes()), nil
+}
+
+// runPubkey implements the "pubkey" subcommand, like "wg pubkey": the
+// private key is taken from the argument, or read from stdin.
+func runPubkey(args []string) {
+	var key string
+	if len(args) > 0 {
+		key = args[0]
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Fprintln(os.Stderr, "No private key given.")
+			os.Exit(1)
+		}
+		key = line
+	}
+
+	public, err := publicKeyOf(strings.TrimSpace(key))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(public)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestIsValidWgKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"YNqHbfBQKaGvzefSSKbyD/Vzm4ZRo4Hsp5d6JEdLkF0=", true},
+		{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", true},
+		{"", false},
+		{"YNqHbfBQKaGvzefSSKbyD/Vzm4ZRo4Hsp5d6JEdLkF0", false},   // missing padding
+		{"YNqHbfBQKaGvzefSSKbyD/Vzm4ZRo4Hsp5d6JEdLkF", false},    // truncated
+		{"YNqHbfBQKaGvzefSSKbyD/Vzm4ZRo4Hsp5d6JEdLkF0==", false}, // too long
+		{"YNqHbfBQKaGvzefSSKbyD_Vzm4ZRo4Hsp5d6JEdLkF0=", false},  // URL alphabet
+		{"YNqHbfBQKaGvzefSSKbyD/Vzm4ZRo4Hsp5d6JEdLk!0=", false},
+	}
+	for _, tt := range tests {
+		if got := isValidWgKey(tt.key); got != tt.want {
+			t.Errorf("isValidWgKey(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateKeyPair(t *testing.T) {
+	private, public, err := generateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isValidWgKey(private) || !isValidWgKey(public) {
+		t.Fatalf("generated keys aren't valid: %q, %q", private, public)
+	}
+	if derived, err := publicKeyOf(private); err != nil || derived != public {
+		t.Errorf("publicKeyOf(private) = %q, %v; want %q", derived, err, public)
+	}
+}
+
+func TestPublicKeyOf(t *testing.T) {
+	// The X25519 key pairs of RFC 7748, section 6.1
+	tests := []struct {
+		private, public string
+	}{
+		{"dwdtCnMYpX08FsFyUbJmRd9ML4frwJkqsXf7pR25LCo=", "hSDwCYkwp1R0i33ctD73Wg2/Og0mOBr066SpjqqbTmo="},
+		{"XasIfmJKikt54X+Lg4AO5m87sSkmGLb9HC+LJ/+I4Os=", "3p7bfXt9wbTTW2HC7OQ1Nz+DQ8hbeGdNrfx+FG+IK08="},
+	}
+	for _, tt := range tests {
+		if got, err := publicKeyOf(tt.private); err != nil || got != tt.public {
+			t.Errorf("publicKeyOf(%s) = %q, %v; want %q", tt.private, got, err, tt.public)
+		}
+	}
+	if _, err := publicKeyOf("not a key"); err == nil {
+		t.Error("publicKeyOf accepted an invalid key")
+	}
+}
+
+func TestGetPrivateKey(t *testing.T) {
+	setFlags(t, "-retries", "0")
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantErr error
+	}{
+		{"valid key", 200, `{"nordlynx_private_key":"YNqHbfBQKaGvzefSSKbyD/Vzm4ZRo4Hsp5d6JEdLkF0="}`, nil},
+		{"truncated key", 200, `{"nordlynx_private_key":"YNqHbfBQKaGvzefSSKbyD/Vzm4"}`, errMalformedKey},
+		{"missing key", 200, `{}`, errMalformedKey},
+		{"rejected token", 401, ``, errUnauthorized},
+		{"outage", 503, ``, errUpstream},
+		{"rate limited", 429, ``, errUpstream},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serveAPI(t, func(w http.ResponseWriter, r *http.Request) {
+				if user, token, ok := r.BasicAuth(); !ok || user != "token" || token != "secret" {
+					t.Errorf("credentials sent as %q/%q", user, token)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})
+			key, err := getPrivateKey(context.Background(), "secret")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("getPrivateKey error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && !strings.HasPrefix(key, "YNqH") {
+				t.Errorf("getPrivateKey = %q", key)
+			}
+		})
+	}
+}
+
+func TestGetPrivateKeyNetworkError(t *testing.T) {
+	setFlags(t, "-retries", "0")
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	old := apiBase
+	apiBase = srv.URL
+	t.Cleanup(func() { apiBase = old })
+
+	if _, err := getPrivateKey(context.Background(), "secret"); !errors.Is(err, errUpstream) {
+		t.Errorf("getPrivateKey with the API down = %v, want %v", err, errUpstream)
+	}
+}
+
+func TestReadPrivateKey(t *testing.T) {
+	setFlags(t, "-retries", "0")
+	quietRun(t)
+	var tokens []string
+	statuses := []int{}
+	serveAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		_, token, _ := r.BasicAuth()
+		tokens = append(tokens, token)
+		w.WriteHeader(statuses[0])
+		statuses = statuses[1:]
+		w.Write([]byte(`{"nordlynx_private_key":"YNqHbfBQKaGvzefSSKbyD/Vzm4ZRo4Hsp5d6JEdLkF0="}`))
+	})
+
+	// A rejected token is asked for again until the attempts run out
+	statuses = []int{401, 401, 401, 200}
+	in := bufio.NewReader(strings.NewReader("a\nb\nc\nd\n"))
+	if _, err := readPrivateKey(in, io.Discard); err == nil {
+		t.Error("readPrivateKey didn't give up after three rejected tokens")
+	}
+	if !slices.Equal(tokens, []string{"a", "b", "c"}) {
+		t.Errorf("tried tokens %v, want a, b and c", tokens)
+	}
+
+	// After an outage the same token is tried again
+	tokens, statuses = nil, []int{503, 200}
+	in = bufio.NewReader(strings.NewReader("a\n\n"))
+	if key, err := readPrivateKey(in, io.Discard); err != nil || !isValidWgKey(key) {
+		t.Errorf("readPrivateKey = %q, %v after retrying the outage", key, err)
+	}
+	if !slices.Equal(tokens, []string{"a", "a"}) {
+		t.Errorf("tried tokens %v, want a twice", tokens)
+	}
+
+	if _, err := readPrivateKey(bufio.NewReader(strings.NewReader("")), io.Discard); err == nil {
+		t.Error("readPrivateKey without input succeeded")
+	}
+}
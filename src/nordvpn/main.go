@@ -1,17 +1,27 @@
 package main
 
 import (
+	"archive/zip"
 	"bufio"
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"math"
-	"net/http"
+	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -19,12 +29,159 @@ var (
 	bestConfigs = make(map[string]map[string]Server)
 )
 
+var (
+	apiRetries     = flag.Int("retries", 3, "how many times to retry a failed NordVPN API call")
+	apiTimeout     = flag.Duration("timeout", time.Minute, "give up on each NordVPN API request, location lookup or hostname lookup after this long, retries included (0 means no limit)")
+	apiRetryDelay  = flag.Duration("retry-delay", 500*time.Millisecond, "base delay between API retries, doubled on each attempt")
+	mobileBundle   = flag.Bool("mobile-bundle", false, "only write a zip of the best config per city for the WireGuard mobile apps")
+	noIPv6         = flag.Bool("no-ipv6", false, "leave ::/0 out of AllowedIPs for IPv4-only networks")
+	nameContains   = flag.String("name-contains", "", "only keep servers whose name contains this text")
+	limit          = flag.Int("limit", 0, "only write the top N standard configs (0 means all)")
+	toStdout       = flag.Bool("stdout", false, "write the configs to stdout instead of files")
+	dirPattern     = flag.String("dir-pattern", "", "output directory name, relative to the current directory; {ts}, {date} and {layout:<Go time layout>} are filled in")
+	endpointMode   = flag.String("endpoint", "station", "peer endpoint to use: hostname, station, station6 (IPv6 station) or ip (hostname resolved now)")
+	dns            = flag.String("dns", "103.86.96.100", "comma-separated DNS servers: IPv4, IPv6 or hostnames, or none")
+	diffDir        = flag.String("diff", "", "print what changed since the run saved in this directory")
+	maxLoad        = flag.Int("max-load", 100, "skip servers with a load above this percentage")
+	minDistance    = flag.Float64("min-distance", 0, "skip servers closer than this many kilometers")
+	maxDistance    = flag.Float64("max-distance", 0, "skip servers farther than this many kilometers (0 means no limit)")
+	amnezia        = flag.Bool("amnezia", false, "add AmneziaWG obfuscation settings to the [Interface] section")
+	amneziaParams  = flag.String("amnezia-params", "", "AmneziaWG overrides, e.g. \"Jc=5,Jmin=50,Jmax=100\"")
+	includeOff     = flag.Bool("include-offline", false, "keep servers NordVPN reports as offline or in maintenance")
+	writeCSV       = flag.Bool("csv", false, "also write the server list as servers.csv")
+	compactJSON    = flag.Bool("compact-json", false, "write servers.json without indentation")
+	compat         = flag.String("compat", "standard", "config layout: standard (wg-quick) or nordvpn (NordVPN app key order)")
+	dnsPreset      = flag.String("dns-preset", "", "named DNS servers: nordvpn, cloudflare, google or quad9 (-dns wins)")
+	resumeDir      = flag.String("resume", "", "continue an interrupted run in this directory, skipping configs already written")
+	jsonOut        = flag.Bool("json", false, "print a JSON summary instead of progress messages; errors go to stderr as JSON")
+	label          = flag.String("label", "", "add a \"# label: <text>\" comment to every config")
+	noDNS          = flag.Bool("no-dns", false, "leave the DNS line out of the configs (same as -dns none)")
+	virtualOnly    = flag.Bool("virtual-only", false, "only keep virtual location servers")
+	physicalOnly   = flag.Bool("physical-only", false, "skip virtual location servers")
+	annotate       = flag.Bool("annotate", false, "add a comment with the server's load, distance and location to every config")
+	concurrency    = flag.Int("concurrency", 200, "how many config files to write at the same time")
+	locality       = flag.Bool("locality", false, "write one country at a time to keep disk writes within few directories")
+	endpointSuffix = flag.String("endpoint-suffix", "", "with -endpoint hostname, use the short server name plus this domain, e.g. us1234.internal")
+	requireResolv  = flag.Bool("require-resolvable", false, "with -endpoint ip, skip servers whose hostname doesn't resolve")
+	proxyURL       = flag.String("proxy", "", "send API requests through this proxy (http://, https:// or socks5://)")
+	caFile         = flag.String("ca-file", "", "trust the PEM CA certificates in this file for API requests, in addition to the system roots")
+	insecure       = flag.Bool("insecure", false, "INSECURE: skip TLS certificate verification for API requests")
+	address        = flag.String("address", "10.5.0.2/16", "interface Address: an IPv4 CIDR, optionally followed by a comma and an IPv6 CIDR")
+	ipv6Only       = flag.Bool("ipv6-only", false, "route only IPv6 through the tunnel, using an IPv6 interface address (needs IPv6 -dns servers)")
+	allowedIPs     = flag.String("allowed-ips", "", "comma-separated AllowedIPs for split tunneling (default all traffic)")
+	verbose        = flag.Bool("verbose", false, "print each server left out and why")
+	sortBy         = flag.String("sort", "load", "server order: load, distance, name or city; the best config per city is still the lowest load")
+	format         = flag.String("format", "wgquick", "config format: wgquick (.conf) or nm (NetworkManager .nmconnection keyfile)")
+	keepalive      = flag.Int("keepalive", 25, "PersistentKeepalive in seconds (15-120), or 0 to leave it out")
+	withGroups     = flag.Bool("with-groups", false, "add each server's specialty group labels (P2P, Onion Over VPN, ...) to servers.json")
+	stable         = flag.Bool("stable", false, "write to "+stableDir+", replacing the previous run, without per-run details, so runs over the same servers give identical files (needs -lat/-lon or -no-geo)")
+	force          = flag.Bool("force", false, "write into a -dir-pattern directory even if it isn't empty")
+	dedup          = flag.Bool("dedup", false, "symlink configs identical to one already written instead of writing them again")
+	routesFile     = flag.String("routes-file", "", "JSON file mapping country codes to AllowedIPs lists; other countries use the global AllowedIPs")
+	noLAN          = flag.Bool("exclude-lan", false, "keep private, unique local and link-local networks out of the tunnel")
+	dnsInTunnel    = flag.Bool("dns-in-tunnel", false, "always route the DNS servers through the tunnel by adding them to AllowedIPs")
+	countryFilter  = flag.String("country", "", "only keep servers in this country, by name (\"United States\") or ISO code (\"us\")")
+	manualLat      = flag.Float64("lat", 0, "your latitude; with -lon, skips the location lookup")
+	manualLon      = flag.Float64("lon", 0, "your longitude; with -lat, skips the location lookup")
+	noGeo          = flag.Bool("no-geo", false, "don't look up your location and sort by load only")
+	autoCountry    = flag.Bool("auto-country", false, "only keep servers in the country you are connecting from")
+)
+
+// stableDir is the fixed output directory used with -stable.
+const stableDir = "nordvpn_configs"
+
+// maxTokenAttempts is how many times the private key is requested before giving up.
+const maxTokenAttempts = 3
+
+// ipv6Address is the interface address used with -ipv6-only.
+const ipv6Address = "fd00::2/64"
+
+// amneziaSettings holds the parsed -amnezia-params, or nil without -amnezia.
+var amneziaSettings map[string]uint64
+
+// dnsPresets maps -dns-preset names to their DNS servers.
+var dnsPresets = map[string]string{
+	"nordvpn":    "103.86.96.100",
+	"cloudflare": "1.1.1.1, 1.0.0.1",
+	"google":     "8.8.8.8, 8.8.4.4",
+	"quad9":      "9.9.9.9",
+}
+
+// layoutPlaceholder matches a {layout:...} placeholder in -dir-pattern.
+var layoutPlaceholder = regexp.MustCompile(`\{layout:([^{}]+)\}`)
+
+var hostnameLabel = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// outDir is the directory all output is written to, derived from -dir-pattern.
+var outDir string
+
+// status receives progress messages; it is stderr when configs go to stdout.
+var status io.Writer = os.Stdout
+
+// progressOut receives the "saved X/Y" progress line; it is discarded with -json.
+var progressOut io.Writer = os.Stderr
+
+// Repeatable country filters, by name or ISO code.
+var includeCountries, excludeCountries listFlag
+
+// groupFilter holds the -group names.
+var groupFilter listFlag
+
+func init() {
+	flag.IntVar(limit, "n", 0, "shorthand for -limit")
+	flag.IntVar(concurrency, "c", 200, "shorthand for -concurrency")
+	flag.Var(&includeCountries, "include-country", "only keep servers in these countries, by name or ISO code (repeatable or comma-separated)")
+	flag.Var(&excludeCountries, "exclude-country", "drop servers in these countries, by name or ISO code (repeatable or comma-separated)")
+	flag.Var(&groupFilter, "group", "only keep servers in these groups, e.g. \"P2P\" or \"Double VPN\" (repeatable or comma-separated)")
+}
+
+// listFlag is a flag that can be repeated, each value holding one or more
+// comma-separated entries.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, splitList(value)...)
+	return nil
+}
+
+// runStats counts the config files written. The counters are updated from
+// the writer goroutines, so they must only be touched atomically.
+type runStats struct {
+	written    atomic.Int64
+	failed     atomic.Int64
+	skipped    atomic.Int64
+	duplicates atomic.Int64
+}
+
+var stats runStats
+
+// writeError describes a config that couldn't be written, for errors.json.
+type writeError struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+var (
+	writeErrorsMu sync.Mutex
+	writeErrors   []writeError
+)
+
 var serversByLocation = make(map[string]map[string]map[string]interface{})
 
+// groupTitles maps group ids to titles for -with-groups, or is nil without it.
+var groupTitles map[int]string
+
 type Server struct {
 	Name         string `json:"name"`
+	Hostname     string `json:"hostname"`
 	Station      string `json:"station"`
+	StationV6    string `json:"ipv6_station"`
 	Load         int    `json:"load"`
+	Status       string `json:"status"`
 	Distance     float64
 	Technologies []struct {
 		Identifier string `json:"identifier"`
@@ -36,6 +193,7 @@ type Server struct {
 	Locations []struct {
 		Country struct {
 			Name string `json:"name"`
+			Code string `json:"code"`
 			City struct {
 				Name string `json:"name"`
 			} `json:"city"`
@@ -43,71 +201,509 @@ type Server struct {
 		Latitude  float64 `json:"latitude"`
 		Longitude float64 `json:"longitude"`
 	} `json:"locations"`
+	Groups []struct {
+		ID         int    `json:"id"`
+		Title      string `json:"title"`
+		Identifier string `json:"identifier"`
+	} `json:"groups"`
+	Specifications []struct {
+		Identifier string `json:"identifier"`
+		Values     []struct {
+			Value string `json:"value"`
+		} `json:"values"`
+	} `json:"specifications"`
 }
 
 type Location struct {
-	Loc string `json:"loc"`
+	Loc     string `json:"loc"`
+	Country string `json:"country"`
 }
 
 func main() {
+	// Subcommands that don't generate configs
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "genkey":
+			runGenkey()
+			return
+		case "pubkey":
+			runPubkey(os.Args[2:])
+			return
+		case "check":
+			runCheck(os.Args[2:])
+			return
+		case "quick":
+			quickOutput = flag.String("output", "", "file to write the config to (default nordvpn.conf)")
+			flag.Usage = quickUsage
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+	}
+
+	flag.Parse()
+	start := time.Now()
+	// Keep stdout to the configs, errors in the flags included
+	if *toStdout {
+		status = os.Stderr
+	}
+	if err := validateFlags(); err != nil {
+		fatal(2, err)
+	}
+	if err := setupClient(); err != nil {
+		fatal(2, err)
+	}
+	// The token prompt stays visible when progress messages are discarded
+	prompt := status
+	if *jsonOut {
+		status, prompt, progressOut = io.Discard, os.Stderr, io.Discard
+	}
+	outDir, _ = outputDirName(*dirPattern, time.Now())
+	if *resumeDir != "" {
+		outDir = *resumeDir
+	}
+	if *stable {
+		outDir = stableDir
+	}
+	if *dirPattern != "" && !*toStdout && quickOutput == nil {
+		if err := checkOutputDir(outDir); err != nil {
+			fatal(2, err)
+		}
+	}
+	if outDir != "" && !*toStdout && quickOutput == nil {
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			fatal(1, err)
+		}
+	}
+
 	// Prompt user for token
-	reader := bufio.NewReader(os.Stdin)
-	var privateKey string
-	for {
-		fmt.Print("Enter your token: ")
-		token, _ := reader.ReadString('\n')
-		token = strings.TrimSpace(token)
+	privateKey, err := readPrivateKey(bufio.NewReader(os.Stdin), prompt)
+	if err != nil {
+		fatal(1, err)
+	}
+
+	// Stop cleanly on Ctrl+C from here on
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	geo, lat, lon, err := locate(ctx)
+	exitIfCancelled(ctx)
+	if err != nil {
+		fatal(1, "Failed to determine your country:", err)
+	}
+
+	// Get servers
+	fmt.Fprintln(status, "Getting servers...")
+	servers, err := getServers(ctx)
+	exitIfCancelled(ctx)
+	if err != nil {
+		fatal(1, "Failed to get servers:", err)
+	}
+	fetched := len(servers)
+
+	// Group labels are a nice-to-have, so a failed lookup only costs the labels
+	if *withGroups {
+		groups, err := getGroups(ctx)
+		exitIfCancelled(ctx)
+		if err != nil {
+			fmt.Fprintln(status, "Failed to get server groups, continuing without labels:", err)
+		} else {
+			groupTitles = make(map[int]string, len(groups))
+			for _, group := range groups {
+				groupTitles[group.ID] = group.Title
+			}
+		}
+	}
+
+	servers = selectServers(ctx, servers, geo, lat, lon)
+	exitIfCancelled(ctx)
+	if len(servers) == 0 {
+		fatal(1, "No servers match the given filters.")
+	}
+	if *endpointMode == "station6" {
+		missing := 0
+		for _, server := range servers {
+			if server.StationV6 == "" {
+				missing++
+			}
+		}
+		if missing > 0 {
+			fmt.Fprintf(status, "Warning: %d servers have no IPv6 station, using their hostname instead.\n", missing)
+		}
+	}
+
+	if quickOutput != nil {
+		if err := saveQuick(privateKey, servers, *quickOutput); err != nil {
+			fatal(1, "Failed to save config:", err)
+		}
+		return
+	}
+
+	total, err := generate(ctx, privateKey, servers, outDir)
+	exitIfCancelled(ctx)
+	if err != nil {
+		fatal(1, err)
+	}
+	printSummary(start, total, fetched-len(servers))
+	if len(writeErrors) > 0 {
+		os.Exit(1)
+	}
+}
+
+// readPrivateKey asks for a token on prompt, reading it from in, and fetches
+// the Nordlynx private key with it. A rejected token is asked for again, up
+// to maxTokenAttempts tries; after an API outage the same token may be retried.
+func readPrivateKey(in *bufio.Reader, prompt io.Writer) (string, error) {
+	var token string
+	for attempt, retry := 1, false; ; attempt++ {
+		if !retry {
+			fmt.Fprint(prompt, "Enter your token: ")
+			line, err := in.ReadString('\n')
+			if err != nil && line == "" {
+				return "", errors.New("no token given")
+			}
+			token = strings.TrimSpace(line)
+		}
 
 		// Get the Nordlynx private key
-		fmt.Println("Getting Nordlynx private key...")
-		privateKey = getPrivateKey(token)
-		if privateKey == "" {
-			fmt.Println("Failed to retrieve Nordlynx Private Key. The token might be incorrect.")
-			continue
+		fmt.Fprintln(status, "Getting Nordlynx private key...")
+		key, err := getPrivateKey(context.Background(), token)
+		if err == nil {
+			return key, nil
+		}
+		switch {
+		case errors.Is(err, errUnauthorized):
+			fmt.Fprintln(prompt, "Your token has expired or is invalid.")
+		case errors.Is(err, errUpstream):
+			fmt.Fprintln(prompt, err)
+		default:
+			fmt.Fprintln(prompt, "Failed to retrieve Nordlynx Private Key:", err)
+		}
+		if attempt == maxTokenAttempts {
+			return "", fmt.Errorf("giving up after %d attempts", attempt)
+		}
+
+		// An outage isn't the token's fault, so offer to try the same one again
+		retry = false
+		if errors.Is(err, errUpstream) {
+			fmt.Fprint(prompt, "Retry with the same token? [Y/n] ")
+			answer, _ := in.ReadString('\n')
+			answer = strings.ToLower(strings.TrimSpace(answer))
+			retry = answer == "" || answer == "y" || answer == "yes"
 		}
-		break
 	}
+}
 
-	// Get user's location
-	fmt.Println("Getting user's location...")
-	loc := getLocation()
-	lat, lon := parseLocation(loc.Loc)
+// locate returns the coordinates servers are sorted by: -lat/-lon when
+// given, otherwise the looked-up location. geo is false with -no-geo or
+// when the lookup fails, which only costs the distances. With -auto-country
+// the lookup also sets -country, and its failure is returned.
+func locate(ctx context.Context) (geo bool, lat, lon float64, err error) {
+	geo = !*noGeo
+	lat, lon = *manualLat, *manualLon
+	lookupCoords := geo && !(isFlagSet("lat") && isFlagSet("lon"))
+	if !lookupCoords && !*autoCountry {
+		return geo, lat, lon, nil
+	}
 
-	// Get servers
-	fmt.Println("Getting servers...")
-	servers := getServers()
+	fmt.Fprintln(status, "Getting user's location...")
+	loc, err := getLocation(ctx)
+	if *autoCountry {
+		if err == nil && loc.Country == "" {
+			err = errors.New("location lookup returned no country")
+		}
+		if err != nil {
+			return false, 0, 0, err
+		}
+		fmt.Fprintln(status, "Keeping servers in your country:", loc.Country)
+		*countryFilter = loc.Country
+	}
+	if err == nil && lookupCoords {
+		lat, lon, err = parseLocation(loc.Loc)
+	}
+	if err != nil && lookupCoords {
+		fmt.Fprintln(status, "Warning: could not determine location, sorting by load only:", err)
+		geo = false
+	}
+	return geo, lat, lon, nil
+}
+
+// selectServers sorts servers by the -sort key and drops those that can't
+// be used or don't match the filters, resolving hostnames for -endpoint ip.
+func selectServers(ctx context.Context, servers []Server, geo bool, lat, lon float64) []Server {
+	// Servers without a location can't be sorted or filed by country
+	located := servers[:0]
+	for _, server := range servers {
+		switch {
+		case len(server.Locations) == 0:
+			rejectServer(server, "no-location")
+		case server.Locations[0].Country.Code == "":
+			rejectServer(server, "no-country-code")
+		default:
+			located = append(located, server)
+		}
+	}
+	servers = located
 
 	// Sort servers
-	fmt.Println("Sorting servers...")
-	sortServers(servers, lat, lon)
+	fmt.Fprintln(status, "Sorting servers...")
+	sortServers(servers, geo, lat, lon)
 
-	// Save configs
-	fmt.Println("Saving configs...")
-	var wg sync.WaitGroup
+	if !geo && *sortBy == "distance" {
+		fmt.Fprintln(status, "Warning: location unknown, sorting by load instead of distance")
+	}
+	if !geo && (*minDistance > 0 || *maxDistance > 0) {
+		fmt.Fprintln(status, "Warning: location unknown, ignoring -min-distance and -max-distance")
+	}
+
+	// Drop servers without a WireGuard public key or not matching the filters
+	nameFilter := strings.ToLower(cleanServerName(*nameContains))
+	usable := servers[:0]
+	seen := make(map[string]bool)
+	outOfRange, offline, overloaded := 0, 0, 0
 	for _, server := range servers {
-		wg.Add(1)
-		go func(server Server) {
-			defer wg.Done()
-			saveConfig(privateKey, server)
-		}(server)
+		if findPublicKey(server) == "" {
+			rejectServer(server, "no-pubkey")
+			continue
+		}
+		// Servers are sorted, so the better of two with the same name is kept
+		if seen[server.Name] {
+			rejectServer(server, "duplicate")
+			continue
+		}
+		seen[server.Name] = true
+		if !*includeOff && server.Status != "" && server.Status != "online" {
+			rejectServer(server, "offline")
+			offline++
+			continue
+		}
+		if nameFilter != "" && !strings.Contains(strings.ToLower(cleanServerName(server.Name)), nameFilter) {
+			rejectServer(server, "name-filter")
+			continue
+		}
+		if *countryFilter != "" && !matchCountry(server, *countryFilter) {
+			rejectServer(server, "country-filter")
+			continue
+		}
+		if len(includeCountries) > 0 && !matchAnyCountry(server, includeCountries) {
+			rejectServer(server, "country-filter")
+			continue
+		}
+		if matchAnyCountry(server, excludeCountries) {
+			rejectServer(server, "country-filter")
+			continue
+		}
+		if len(groupFilter) > 0 && !inGroup(server, groupFilter) {
+			rejectServer(server, "group-filter")
+			continue
+		}
+		if (*virtualOnly && !isVirtual(server)) || (*physicalOnly && isVirtual(server)) {
+			rejectServer(server, "virtual-filter")
+			continue
+		}
+		if server.Load > *maxLoad {
+			rejectServer(server, "load")
+			overloaded++
+			continue
+		}
+		if geo && (server.Distance < *minDistance || (*maxDistance > 0 && server.Distance > *maxDistance)) {
+			rejectServer(server, "distance")
+			outOfRange++
+			continue
+		}
+		usable = append(usable, server)
+	}
+	servers = usable
+	if offline > 0 {
+		fmt.Fprintf(status, "Skipped %d offline servers.\n", offline)
+	}
+	if overloaded > 0 {
+		fmt.Fprintf(status, "Skipped %d servers above %d%% load.\n", overloaded, *maxLoad)
+	}
+	if outOfRange > 0 {
+		fmt.Fprintf(status, "Skipped %d servers outside the distance range.\n", outOfRange)
+	}
+	if *endpointMode == "ip" {
+		fmt.Fprintln(status, "Resolving server hostnames...")
+		before := len(servers)
+		servers = resolveEndpoints(ctx, servers, *requireResolv)
+		if n := before - len(servers); n > 0 {
+			fmt.Fprintf(status, "Skipped %d servers whose hostname doesn't resolve.\n", n)
+		}
+	}
+	return servers
+}
+
+// generate writes the configs of servers, already sorted and filtered, and
+// the server lists into dir, as the flags ask. It returns how many standard
+// configs were due; failed writes are left in writeErrors. Once ctx is
+// cancelled no new configs are started and ctx's error is returned.
+func generate(ctx context.Context, privateKey string, servers []Server, dir string) (int, error) {
+	outDir = dir
+	bestConfigs = make(map[string]map[string]Server)
+	serversByLocation = make(map[string]map[string]map[string]interface{})
+	stats = runStats{}
+	writeErrors = nil
+
+	if *diffDir != "" {
+		fmt.Fprintln(status, "Comparing with", *diffDir+"...")
+		if err := diffRun(status, *diffDir, servers); err != nil {
+			fmt.Fprintln(status, "Failed to compare with previous run:", err)
+		}
+	}
+
+	// Replace the previous stable run only once there is something to write
+	if *stable && !*toStdout {
+		if err := clearOutput(outDir); err != nil {
+			return 0, err
+		}
+	}
+
+	// Index servers by location and pick the best one per city
+	for _, server := range servers {
+		recordServer(server)
+	}
+
+	if *mobileBundle {
+		fmt.Fprintln(status, "Saving mobile bundle...")
+		return 0, saveMobileBundle(privateKey, filepath.Join(outDir, "nordvpn_mobile.zip"))
+	}
+
+	// Keep only the top configs if a limit is set
+	standard := servers
+	if *limit > 0 && *limit < len(standard) {
+		standard = standard[:*limit]
+	}
+
+	if *toStdout {
+		return len(standard), writeConfigStream(os.Stdout, privateKey, standard)
+	}
+
+	// Record progress so an interrupted run can be resumed
+	var err error
+	journal, err = openJournal(filepath.Join(outDir, progressFile), *resumeDir != "")
+	if err != nil {
+		return 0, fmt.Errorf("failed to open progress journal: %w", err)
+	}
+	dedupIndex = nil
+	if *dedup {
+		dedupIndex = &contentIndex{}
+	}
+
+	// Save configs
+	fmt.Fprintf(status, "Saving configs (%d of %d available)...\n", len(standard), len(servers))
+	stopProgress := startProgress(progressOut, len(standard))
+	if *locality {
+		for _, group := range groupByCountry(standard) {
+			saveConfigs(ctx, privateKey, group)
+		}
+	} else {
+		saveConfigs(ctx, privateKey, standard)
+	}
+	stopProgress()
+	if ctx.Err() != nil {
+		journal.close()
+		return 0, ctx.Err()
 	}
-	wg.Wait()
 
 	// Save best configs
-	fmt.Println("Saving best configs...")
+	fmt.Fprintln(status, "Saving best configs...")
 	for country, cities := range bestConfigs {
 		for city, server := range cities {
-			dir := filepath.Join("best_configs", fmt.Sprintf("%s_%s.conf", country, city))
-			saveConfig(privateKey, server, dir)
+			path := filepath.Join(outDir, "best_configs", fmt.Sprintf("%s_%s%s", country, city, configExt()))
+			saveConfig(privateKey, server, path)
 		}
 	}
 
-	fmt.Println("Formatting JSON output...")
-	b, err := json.MarshalIndent(serversByLocation, "", "  ")
+	fmt.Fprintln(status, "Formatting JSON output...")
+	addCityStats()
+	b, err := marshalServers(*compactJSON)
 	if err != nil {
-		fmt.Println("Failed to marshal JSON:", err)
+		return 0, fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(outDir, "servers.json"), b, 0644); err != nil {
+		return 0, err
+	}
+
+	if *writeCSV {
+		fmt.Fprintln(status, "Saving CSV output...")
+		if err := saveServersCSV(filepath.Join(outDir, "servers.csv"), servers); err != nil {
+			return 0, err
+		}
+	}
+
+	// A finished run has nothing left to resume
+	journal.close()
+	if stats.failed.Load() == 0 {
+		os.Remove(filepath.Join(outDir, progressFile))
+	}
+
+	if n := stats.skipped.Load(); n > 0 {
+		fmt.Fprintf(status, "Skipped %d configs written by the previous run.\n", n)
+	}
+	if n := stats.duplicates.Load(); n > 0 {
+		fmt.Fprintf(status, "Linked %d configs identical to one already written.\n", n)
+	}
+	fmt.Fprintf(status, "Saved %d configs (%d failed).\n", stats.written.Load(), stats.failed.Load())
+
+	// Keep a record of failed writes so an incomplete output is noticed
+	if len(writeErrors) > 0 {
+		sort.Slice(writeErrors, func(i, j int) bool {
+			return writeErrors[i].Path < writeErrors[j].Path
+		})
+		b, _ := json.MarshalIndent(writeErrors, "", "  ")
+		if err := os.WriteFile(filepath.Join(outDir, "errors.json"), b, 0644); err != nil {
+			fmt.Fprintln(status, err)
+		}
+		fmt.Fprintf(status, "Output is incomplete, see %s.\n", filepath.Join(outDir, "errors.json"))
+	}
+	return len(standard), nil
+}
+
+// printSummary prints the -json result of a run.
+func printSummary(start time.Time, total, rejected int) {
+	if !*jsonOut {
 		return
 	}
+	best := 0
+	for _, cities := range bestConfigs {
+		best += len(cities)
+	}
+	dir, err := filepath.Abs(filepath.Join(outDir, "."))
+	if err != nil {
+		dir = outDir
+	}
+	json.NewEncoder(os.Stdout).Encode(struct {
+		OutputDir      string       `json:"outputDir"`
+		Total          int          `json:"total"`
+		Best           int          `json:"best"`
+		Rejected       int          `json:"rejected"`
+		Failed         int64        `json:"failed"`
+		Errors         []writeError `json:"errors,omitempty"`
+		ElapsedSeconds float64      `json:"elapsedSeconds"`
+	}{dir, total, best, rejected, stats.failed.Load(), writeErrors, time.Since(start).Seconds()})
+}
+
+// fatal reports an error and exits with code. With -json the error is
+// written to stderr as {"error": "..."}.
+func fatal(code int, args ...interface{}) {
+	msg := strings.TrimSuffix(fmt.Sprintln(args...), "\n")
+	if *jsonOut {
+		json.NewEncoder(os.Stderr).Encode(map[string]string{"error": msg})
+	} else {
+		fmt.Fprintln(status, msg)
+	}
+	os.Exit(code)
+}
+
+// marshalServers encodes serversByLocation for servers.json, either minified
+// or indented with each server entry kept on one line.
+func marshalServers(compact bool) ([]byte, error) {
+	if compact {
+		return json.Marshal(serversByLocation)
+	}
+	b, err := json.MarshalIndent(serversByLocation, "", "  ")
+	if err != nil {
+		return nil, err
+	}
 	// Convert bytes to string
 	s := string(b)
 	// Remove newlines after commas in arrays
@@ -118,119 +714,707 @@ func main() {
 	s = strings.Replace(s, "[\n        ", "[", -1)
 	// Convert string back to bytes
 	b = []byte(s)
-	if err := os.WriteFile("servers.json", b, 0644); err != nil {
-		fmt.Println(err)
-		return
-	}
+	return b, nil
 }
 
-func getLocation() Location {
-	resp, err := http.Get("https://ipinfo.io/json")
+// saveServersCSV writes one row per server with its location, load and addresses.
+func saveServersCSV(filename string, servers []Server) error {
+	f, err := os.Create(filename)
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		return err
 	}
-	defer resp.Body.Close()
+	defer f.Close()
 
-	var loc Location
-	if err := json.NewDecoder(resp.Body).Decode(&loc); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	w := csv.NewWriter(f)
+	w.Write([]string{"name", "country", "city", "code", "load", "distance_km", "hostname", "station"})
+	for _, server := range servers {
+		country := server.Locations[0].Country
+		w.Write([]string{
+			server.Name,
+			country.Name,
+			country.City.Name,
+			strings.ToLower(country.Code),
+			strconv.Itoa(server.Load),
+			strconv.FormatFloat(math.Round(server.Distance), 'f', -1, 64),
+			server.Hostname,
+			server.Station,
+		})
 	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
 
-	return loc
+// exitIfCancelled stops the program once Ctrl+C cancelled ctx.
+func exitIfCancelled(ctx context.Context) {
+	if ctx.Err() != nil {
+		fatal(130, "Cancelled, output may be incomplete.")
+	}
 }
 
-func parseLocation(loc string) (float64, float64) {
-	parts := strings.Split(loc, ",")
-	lat, _ := strconv.ParseFloat(parts[0], 64)
-	lon, _ := strconv.ParseFloat(parts[1], 64)
-	return lat, lon
+// apiFlags are the flags that shape API requests, shared with subcommands
+// that call the API.
+var apiFlags = []string{"proxy", "ca-file", "insecure", "retries", "retry-delay", "timeout"}
+
+// validateAPIFlags checks the apiFlags values.
+func validateAPIFlags() error {
+	if *apiRetries < 0 {
+		return fmt.Errorf("invalid -retries %d: must be 0 or more", *apiRetries)
+	}
+	if *apiRetryDelay <= 0 {
+		return fmt.Errorf("invalid -retry-delay %v: must be more than 0", *apiRetryDelay)
+	}
+	if *apiTimeout < 0 {
+		return fmt.Errorf("invalid -timeout %v: must be 0 or more", *apiTimeout)
+	}
+	return nil
 }
 
-func getServers() []Server {
-	resp, err := http.Get("https://api.nordvpn.com/v1/servers?limit=7000&filters[servers_technologies][identifier]=wireguard_udp")
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+// validateFlags reports command line values that can't be used.
+func validateFlags() error {
+	if *limit < 0 {
+		return fmt.Errorf("invalid -limit %d: must be 0 or more", *limit)
+	}
+	if _, ok := serverOrders[*sortBy]; !ok {
+		return fmt.Errorf("invalid -sort %q: must be load, distance, name or city", *sortBy)
+	}
+	if *keepalive != 0 && (*keepalive < 15 || *keepalive > 120) {
+		return fmt.Errorf("invalid -keepalive %d: must be 0 or between 15 and 120", *keepalive)
+	}
+	if err := validateAPIFlags(); err != nil {
+		return err
+	}
+	if *concurrency < 1 {
+		return fmt.Errorf("invalid -concurrency %d: must be 1 or more", *concurrency)
+	}
+	if _, err := outputDirName(*dirPattern, time.Now()); err != nil {
+		return err
+	}
+	if *virtualOnly && *physicalOnly {
+		return fmt.Errorf("-virtual-only and -physical-only can't be used together")
+	}
+	if strings.ContainsAny(*label, "\r\n") {
+		return fmt.Errorf("invalid -label: must be a single line")
+	}
+	if *jsonOut && *toStdout {
+		return fmt.Errorf("-json and -stdout can't be used together")
+	}
+	if *stable && (*annotate || *dirPattern != "" || *resumeDir != "") {
+		return fmt.Errorf("-stable can't be used with -annotate, -dir-pattern or -resume")
+	}
+	// A looked-up location changes with the network, and with it the order and distances
+	if *stable && (*autoCountry || !*noGeo && !(isFlagSet("lat") && isFlagSet("lon"))) {
+		return fmt.Errorf("-stable needs a fixed location: give -lat and -lon, or -no-geo, and no -auto-country")
+	}
+	if *resumeDir != "" && *dirPattern != "" {
+		return fmt.Errorf("-resume and -dir-pattern can't be used together")
+	}
+	switch *endpointMode {
+	case "hostname", "station", "station6", "ip":
+	default:
+		return fmt.Errorf("invalid -endpoint %q: must be hostname, station, station6 or ip", *endpointMode)
+	}
+	if *minDistance < 0 {
+		return fmt.Errorf("invalid -min-distance %v: must be 0 or more", *minDistance)
+	}
+	if len(includeCountries) > 0 && len(excludeCountries) > 0 {
+		return fmt.Errorf("-include-country and -exclude-country can't be used together")
+	}
+	if *autoCountry && *countryFilter != "" {
+		return fmt.Errorf("-auto-country and -country can't be used together")
+	}
+	if isFlagSet("lat") != isFlagSet("lon") {
+		return fmt.Errorf("-lat and -lon must be given together")
+	}
+	if *manualLat < -90 || *manualLat > 90 {
+		return fmt.Errorf("invalid -lat %v: must be between -90 and 90", *manualLat)
+	}
+	if *manualLon < -180 || *manualLon > 180 {
+		return fmt.Errorf("invalid -lon %v: must be between -180 and 180", *manualLon)
+	}
+	if *ipv6Only && *noIPv6 {
+		return fmt.Errorf("-ipv6-only and -no-ipv6 can't be used together")
+	}
+	if *ipv6Only && !isFlagSet("address") {
+		*address = ipv6Address
+	}
+	if len(splitList(*address)) == 0 {
+		return fmt.Errorf("invalid -address %q: no address given", *address)
+	}
+	for _, cidr := range splitList(*address) {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("invalid -address %q: %q is not a CIDR like 10.5.0.2/16", *address, cidr)
+		}
+	}
+	if len(addressList()) == 0 {
+		return fmt.Errorf("-no-ipv6 leaves no interface address from -address %q", *address)
+	}
+	if *allowedIPs != "" {
+		for _, cidr := range strings.Split(*allowedIPs, ",") {
+			if _, _, err := net.ParseCIDR(strings.TrimSpace(cidr)); err != nil {
+				return fmt.Errorf("invalid -allowed-ips entry %q", strings.TrimSpace(cidr))
+			}
+		}
+	}
+	if *maxLoad < 0 || *maxLoad > 100 {
+		return fmt.Errorf("invalid -max-load %d: must be between 0 and 100", *maxLoad)
+	}
+	if *maxDistance < 0 {
+		return fmt.Errorf("invalid -max-distance %v: must be 0 or more", *maxDistance)
+	}
+	if *maxDistance > 0 && *minDistance > *maxDistance {
+		return fmt.Errorf("-min-distance %v is greater than -max-distance %v", *minDistance, *maxDistance)
+	}
+	if *dnsPreset != "" {
+		preset, ok := dnsPresets[strings.ToLower(*dnsPreset)]
+		if !ok {
+			return fmt.Errorf("unknown -dns-preset %q: must be nordvpn, cloudflare, google or quad9", *dnsPreset)
+		}
+		if !isFlagSet("dns") {
+			*dns = preset
+		}
+	}
+	if *noDNS {
+		*dns = "none"
+	}
+	if strings.EqualFold(strings.TrimSpace(*dns), "none") {
+		*dns = "none"
+	}
+	if *requireResolv && *endpointMode != "ip" {
+		return fmt.Errorf("-require-resolvable only applies to -endpoint ip")
+	}
+	if *endpointSuffix != "" && !isHostname(strings.TrimPrefix(*endpointSuffix, ".")) {
+		return fmt.Errorf("invalid -endpoint-suffix %q: must be a domain name", *endpointSuffix)
 	}
-	defer resp.Body.Close()
+	if *endpointSuffix != "" && *endpointMode != "hostname" {
+		return fmt.Errorf("-endpoint-suffix only applies to -endpoint hostname")
+	}
+	if err := validateDNS(*dns); err != nil {
+		return err
+	}
+	// IPv4 stays outside the tunnel, and with it queries to an IPv4 DNS server
+	if *ipv6Only {
+		for _, entry := range dnsList() {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				return fmt.Errorf("-ipv6-only can't use IPv4 DNS server %s: give IPv6 servers with -dns, or -dns none", entry)
+			}
+		}
+	}
+	if *dns != "none" && len(dnsList()) == 0 {
+		return fmt.Errorf("-no-ipv6 leaves no DNS servers from -dns %q", *dns)
+	}
+	if _, ok := configLayouts[*compat]; !ok {
+		return fmt.Errorf("invalid -compat %q: must be standard or nordvpn", *compat)
+	}
+	if *routesFile != "" {
+		routes, err := loadRoutes(*routesFile)
+		if err != nil {
+			return err
+		}
+		countryRoutes = routes
+	}
+	switch *format {
+	case "wgquick":
+	case "nm":
+		if *amnezia || *mobileBundle {
+			return fmt.Errorf("-format nm can't be used with -amnezia or -mobile-bundle")
+		}
+	default:
+		return fmt.Errorf("invalid -format %q: must be wgquick or nm", *format)
+	}
+	if *amnezia {
+		params, err := parseAmnezia(*amneziaParams)
+		if err != nil {
+			return err
+		}
+		amneziaSettings = params
+	}
+	return nil
+}
 
-	var servers []Server
-	if err := json.NewDecoder(resp.Body).Decode(&servers); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+// validateDNS checks that every entry of a comma-separated DNS list is an
+// IPv4 or IPv6 address or an RFC 1123 hostname. "none" means no DNS line.
+func validateDNS(list string) error {
+	if list == "none" {
+		return nil
 	}
+	entries := splitList(list)
+	if len(entries) == 0 {
+		return fmt.Errorf("invalid DNS %q: no servers given", list)
+	}
+	for _, entry := range entries {
+		if net.ParseIP(entry) == nil && !isHostname(entry) {
+			return fmt.Errorf("invalid DNS server %q", entry)
+		}
+	}
+	return nil
+}
 
-	return servers
+// splitList splits a pasted comma-separated list like " 1.1.1.1, 1.0.0.1,,"
+// into its entries, ignoring surrounding spaces and empty parts.
+func splitList(list string) []string {
+	var entries []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
 }
 
-func sortServers(servers []Server, lat, lon float64) {
-	for i := range servers {
-		servers[i].Distance = haversine(lat, lon, servers[i].Locations[0].Latitude, servers[i].Locations[0].Longitude)
+// addressList returns the interface addresses, without IPv6 ones under -no-ipv6.
+func addressList() []string {
+	var list []string
+	for _, cidr := range splitList(*address) {
+		if ip, _, err := net.ParseCIDR(cidr); *noIPv6 && err == nil && ip.To4() == nil {
+			continue
+		}
+		list = append(list, cidr)
 	}
-	sort.Slice(servers, func(i, j int) bool {
-		if servers[i].Load == servers[j].Load {
-			return servers[i].Distance < servers[j].Distance
+	return list
+}
+
+// dnsList returns the configured DNS servers, without IPv6 ones under -no-ipv6.
+func dnsList() []string {
+	if *dns == "none" {
+		return nil
+	}
+	var list []string
+	for _, entry := range splitList(*dns) {
+		if ip := net.ParseIP(entry); *noIPv6 && ip != nil && ip.To4() == nil {
+			continue
+		}
+		list = append(list, entry)
+	}
+	return list
+}
+
+func isHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	labels := strings.Split(name, ".")
+	for _, label := range labels {
+		if !hostnameLabel.MatchString(label) {
+			return false
+		}
+	}
+	// An all-numeric last label is a malformed IP address, not a name
+	_, err := strconv.Atoi(labels[len(labels)-1])
+	return err != nil
+}
+
+// isFlagSet reports whether the named flag was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
 		}
-		return servers[i].Load < servers[j].Load
 	})
+	return set
 }
 
-func saveConfig(privateKey string, server Server, filename ...string) {
-	publicKey := findPublicKey(server)
+// generatedOutputs are the files and directories a run writes into outDir.
+var generatedOutputs = []string{"configs", "best_configs", "servers.json", "servers.csv", "errors.json", "nordvpn_mobile.zip", progressFile}
 
-	if publicKey == "" {
-		fmt.Printf("No WireGuard public key found for %s. Skipping.\n", server.Name)
-		return
+// clearOutput removes what an earlier run left in dir, so configs of
+// servers that have since disappeared don't linger. Other files are kept.
+func clearOutput(dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return fmt.Errorf("output directory %s contains .git, refusing to write into it", dir)
+	}
+	for _, name := range generatedOutputs {
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	config := fmt.Sprintf(`
-[Interface]
-PrivateKey = %s
-Address = 10.5.0.2/16
-DNS = 103.86.96.100
+// checkOutputDir refuses an output directory that would mix our files with
+// unrelated ones: a git checkout, the -diff directory, or any non-empty
+// directory unless -force is given.
+func checkOutputDir(dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return fmt.Errorf("output directory %s contains .git, refusing to write into it", dir)
+	}
+	if *diffDir != "" && filepath.Clean(*diffDir) == filepath.Clean(dir) {
+		return fmt.Errorf("output directory %s is the -diff directory", dir)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(entries) > 0 && !*force {
+		return fmt.Errorf("output directory %s is not empty, use -force to write into it anyway", dir)
+	}
+	return nil
+}
+
+// outputDirName expands a -dir-pattern for time t. The placeholders {ts}
+// (20060102_150405), {date} (2006-01-02) and {layout:<Go time layout>} are
+// filled in; everything else is used as written. An empty pattern means
+// the current directory.
+func outputDirName(pattern string, t time.Time) (string, error) {
+	if pattern == "" {
+		return "", nil
+	}
+
+	name := layoutPlaceholder.ReplaceAllStringFunc(pattern, func(m string) string {
+		return t.Format(layoutPlaceholder.FindStringSubmatch(m)[1])
+	})
+	name = strings.NewReplacer(
+		"{ts}", t.Format("20060102_150405"),
+		"{date}", t.Format("2006-01-02"),
+	).Replace(name)
+
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsAny(name, "{}<>:\"|?*\\") {
+		return "", fmt.Errorf("invalid -dir-pattern %q: gives unusable name %q", pattern, name)
+	}
+	for _, r := range name {
+		if r < ' ' {
+			return "", fmt.Errorf("invalid -dir-pattern %q: contains control characters", pattern)
+		}
+	}
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("invalid -dir-pattern %q: must be a relative path", pattern)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("invalid -dir-pattern %q: must not leave the current directory", pattern)
+		}
+	}
+	return filepath.FromSlash(name), nil
+}
 
-[Peer]
-PublicKey = %s
-AllowedIPs = 0.0.0.0/0, ::/0
-Endpoint = %s:51820
-PersistentKeepalive = 25
-`, privateKey, publicKey, server.Station)
+func parseLocation(loc string) (float64, float64, error) {
+	parts := strings.Split(loc, ",")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid location %q", loc)
+	}
+	lat, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	lon, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return lat, lon, nil
+}
 
-	// Create configs, country, and city directories
-	country := strings.ReplaceAll(server.Locations[0].Country.Name, " ", "_")
+// serverOrders holds the -sort comparators. Each falls back to load and
+// distance so ties are still broken towards the better server.
+var serverOrders = map[string]func(a, b *Server) bool{
+	"load": byLoadDistance,
+	"distance": func(a, b *Server) bool {
+		if a.Distance != b.Distance {
+			return a.Distance < b.Distance
+		}
+		return byLoadDistance(a, b)
+	},
+	"name": func(a, b *Server) bool {
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return byLoadDistance(a, b)
+	},
+	"city": func(a, b *Server) bool {
+		ac, bc := a.Locations[0].Country, b.Locations[0].Country
+		if ac.Name != bc.Name {
+			return ac.Name < bc.Name
+		}
+		if ac.City.Name != bc.City.Name {
+			return ac.City.Name < bc.City.Name
+		}
+		return byLoadDistance(a, b)
+	},
+}
+
+// byLoadDistance is the default order. Full ties go by name so the order
+// doesn't depend on how the API happened to list the servers.
+func byLoadDistance(a, b *Server) bool {
+	if a.Load != b.Load {
+		return a.Load < b.Load
+	}
+	if a.Distance != b.Distance {
+		return a.Distance < b.Distance
+	}
+	return a.Name < b.Name
+}
+
+// sortServers orders servers by the -sort key, by default load and then
+// distance from lat/lon. Without geo the distances stay at 0 and only the
+// load is compared.
+func sortServers(servers []Server, geo bool, lat, lon float64) {
+	if geo {
+		for i := range servers {
+			servers[i].Distance = haversine(lat, lon, servers[i].Locations[0].Latitude, servers[i].Locations[0].Longitude)
+		}
+	}
+	less := serverOrders[*sortBy]
+	sort.Slice(servers, func(i, j int) bool {
+		return less(&servers[i], &servers[j])
+	})
+}
+
+// allowedIPList returns the peer's AllowedIPs for server, taken from
+// -routes-file when its country has an entry. With -dns-in-tunnel every
+// DNS server address not already covered gets its own /32 or /128 route.
+func allowedIPList(server Server) []string {
+	var list []string
+	routes, mapped := serverRoutes(server)
+	switch {
+	case mapped:
+		list = append(list, routes...)
+	case *allowedIPs != "":
+		for _, cidr := range strings.Split(*allowedIPs, ",") {
+			list = append(list, strings.TrimSpace(cidr))
+		}
+	case *noIPv6:
+		list = []string{"0.0.0.0/0"}
+	case *ipv6Only:
+		list = []string{"::/0"}
+	default:
+		list = []string{"0.0.0.0/0", "::/0"}
+	}
+	if *noLAN {
+		list = excludeLAN(list)
+	}
+	if !*dnsInTunnel {
+		return list
+	}
+
+	for _, entry := range dnsList() {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			continue // hostnames can't be routed
+		}
+		covered := false
+		for _, cidr := range list {
+			if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(ip) {
+				covered = true
+				break
+			}
+		}
+		if covered {
+			continue
+		}
+		if ip.To4() != nil {
+			list = append(list, ip.String()+"/32")
+		} else {
+			list = append(list, ip.String()+"/128")
+		}
+	}
+	return list
+}
+
+// endpointHost returns the peer address selected by -endpoint. The ip mode
+// falls back to the station IP when the hostname didn't resolve, station6
+// to the hostname for servers without an IPv6 station.
+func endpointHost(server Server) string {
+	switch *endpointMode {
+	case "hostname":
+		if server.Hostname != "" && *endpointSuffix != "" {
+			short, _, _ := strings.Cut(server.Hostname, ".")
+			return short + "." + strings.TrimPrefix(*endpointSuffix, ".")
+		}
+		if server.Hostname != "" {
+			return server.Hostname
+		}
+	case "ip":
+		if ip, ok := resolvedIP(server.Hostname); ok {
+			return ip
+		}
+	case "station6":
+		if server.StationV6 != "" {
+			return "[" + server.StationV6 + "]"
+		}
+		if server.Hostname != "" {
+			return server.Hostname
+		}
+	}
+	return server.Station
+}
+
+// locationNames returns the directory-safe country and city names of a server.
+func locationNames(server Server) (string, string) {
+	country := strings.ReplaceAll(transliterate(server.Locations[0].Country.Name), " ", "_")
 	country = strings.ReplaceAll(country, "-", "")
-	city := strings.ReplaceAll(server.Locations[0].Country.City.Name, " ", "_")
+	city := strings.ReplaceAll(transliterate(server.Locations[0].Country.City.Name), " ", "_")
 	city = strings.ReplaceAll(city, "-", "")
-	dir := fmt.Sprintf("configs/%s/%s", country, city)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		fmt.Println(err)
+	return country, city
+}
+
+// rejectServer explains with -verbose why a server was left out.
+func rejectServer(server Server, reason string) {
+	if *verbose {
+		fmt.Fprintf(status, "skipped %s: %s\n", server.Name, reason)
+	}
+}
+
+// matchAnyCountry reports whether any of queries names the server's country.
+func matchAnyCountry(server Server, queries []string) bool {
+	for _, query := range queries {
+		if matchCountry(server, query) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchCountry reports whether query names the server's country, either by
+// its ISO code or by its name as written or as used in directory names.
+func matchCountry(server Server, query string) bool {
+	query = strings.TrimSpace(query)
+	country := server.Locations[0].Country
+	dirName, _ := locationNames(server)
+	return strings.EqualFold(query, country.Code) ||
+		strings.EqualFold(query, country.Name) ||
+		strings.EqualFold(query, dirName)
+}
+
+// cleanServerName turns a server name like "United States #1234" into a file name.
+func cleanServerName(name string) string {
+	name = strings.ReplaceAll(name, "#", "")
+	name = strings.ReplaceAll(name, " ", "_")
+	name = strings.ReplaceAll(name, "-", "")
+	name = strings.ReplaceAll(name, "__", "_")
+	return name
+}
+
+// recordWriteError reports a config that couldn't be written and keeps it
+// for errors.json.
+func recordWriteError(rel string, err error) {
+	fmt.Fprintln(status, err)
+	stats.failed.Add(1)
+	writeErrorsMu.Lock()
+	writeErrors = append(writeErrors, writeError{rel, err.Error()})
+	writeErrorsMu.Unlock()
+}
+
+func saveConfig(privateKey string, server Server, filename ...string) {
+	path := configPath(server, filename...)
+	rel, err := filepath.Rel(filepath.Join(outDir, "."), path)
+	if err != nil {
+		rel = path
+	}
+	if journal.isDone(rel) {
+		stats.skipped.Add(1)
 		return
 	}
+	content := renderConfig(privateKey, server)
+	// Where links aren't supported the duplicate is written out in full
+	if first, dup := dedupIndex.lookup(content); dup && linkDuplicate(first, path) == nil {
+		if err := journal.add(rel); err != nil {
+			fmt.Fprintln(status, err)
+		}
+		stats.duplicates.Add(1)
+		return
+	}
+	if err := writeConfig(path, content); err != nil {
+		recordWriteError(rel, err)
+		return
+	}
+	// Only a file that exists may become a link target
+	dedupIndex.add(content, path)
+	if err := journal.add(rel); err != nil {
+		fmt.Fprintln(status, err)
+	}
+	stats.written.Add(1)
+}
 
-	// Clean up the server name
-	serverName := strings.ReplaceAll(server.Name, "#", "")
-	serverName = strings.ReplaceAll(serverName, " ", "_")
-	serverName = strings.ReplaceAll(serverName, "-", "")
-	serverName = strings.ReplaceAll(serverName, "__", "_")
+// saveConfigs writes the configs of servers, at most -concurrency at a
+// time, and stops starting new writes once ctx is cancelled.
+func saveConfigs(ctx context.Context, privateKey string, servers []Server) {
+	sem := make(chan struct{}, *concurrency)
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(server Server) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			saveConfig(privateKey, server)
+		}(server)
+	}
+	wg.Wait()
+}
 
-	// Save the config file in the configs/country/city directory
-	var err error
+// groupByCountry splits servers by country, keeping their order within
+// each group and ordering groups by first appearance.
+func groupByCountry(servers []Server) [][]Server {
+	var groups [][]Server
+	index := make(map[string]int)
+	for _, server := range servers {
+		country, _ := locationNames(server)
+		i, ok := index[country]
+		if !ok {
+			i = len(groups)
+			index[country] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], server)
+	}
+	return groups
+}
+
+// configPath returns where a server's config goes: filename if given,
+// otherwise configs/country/city/name.conf in the output directory.
+func configPath(server Server, filename ...string) string {
 	if len(filename) > 0 {
-		dir := filepath.Dir(filename[0])
-		if err := os.MkdirAll(dir, 0755); err != nil {
-			fmt.Println(err)
-			return
+		return filename[0]
+	}
+	country, city := locationNames(server)
+	return filepath.Join(outDir, "configs", country, city, cleanServerName(server.Name)+configExt())
+}
+
+// writeFile writes a config file; it is a variable so tests can watch the writes.
+var writeFile = os.WriteFile
+
+func writeConfig(path, content string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// A -dedup link from an earlier run must be replaced, not written through
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(path); err != nil {
+			return err
 		}
-		err = os.WriteFile(filename[0], []byte(config), 0644)
-	} else {
-		filename := fmt.Sprintf("%s/%s.conf", dir, serverName)
-		err = os.WriteFile(filename, []byte(config), 0644)
 	}
-	if err != nil {
-		fmt.Println(err)
+	// NetworkManager ignores keyfiles readable by other users
+	perm := os.FileMode(0644)
+	if *format == "nm" {
+		perm = 0600
 	}
+	return writeFile(path, []byte(content), perm)
+}
+
+// writeConfigStream writes the configs one after another, each preceded by
+// a "# === <name> ===" delimiter line.
+func writeConfigStream(w io.Writer, privateKey string, servers []Server) error {
+	bw := bufio.NewWriter(w)
+	for _, server := range servers {
+		fmt.Fprintf(bw, "# === %s ===\n", cleanServerName(server.Name))
+		bw.WriteString(renderConfig(privateKey, server))
+	}
+	return bw.Flush()
+}
+
+// recordServer updates the best config and the serversByLocation index for a server.
+func recordServer(server Server) {
+	country, city := locationNames(server)
 
 	// Update the best config for the country and city
 	mu.Lock()
@@ -238,7 +1422,7 @@ PersistentKeepalive = 25
 	if _, ok := bestConfigs[country]; !ok {
 		bestConfigs[country] = make(map[string]Server)
 	}
-	if _, ok := bestConfigs[country][city]; !ok || server.Load < bestConfigs[country][city].Load {
+	if best, ok := bestConfigs[country][city]; !ok || betterServer(server, best) {
 		bestConfigs[country][city] = server
 	}
 
@@ -251,7 +1435,132 @@ PersistentKeepalive = 25
 		serversByLocation[country][city]["distance"] = math.Round(server.Distance)
 		serversByLocation[country][city]["servers"] = make([][]interface{}, 0)
 	}
-	serversByLocation[country][city]["servers"] = append(serversByLocation[country][city]["servers"].([][]interface{}), []interface{}{server.Name, server.Load})
+	entry := []interface{}{server.Name, server.Load}
+	if groupTitles != nil {
+		entry = append(entry, groupLabels(server))
+	}
+	serversByLocation[country][city]["servers"] = append(serversByLocation[country][city]["servers"].([][]interface{}), entry)
+}
+
+// groupLabels returns the titles of the groups the server belongs to.
+func groupLabels(server Server) []string {
+	labels := []string{}
+	for _, group := range server.Groups {
+		title := group.Title
+		if t, ok := groupTitles[group.ID]; ok {
+			title = t
+		}
+		if title != "" {
+			labels = append(labels, title)
+		}
+	}
+	return labels
+}
+
+// inGroup reports whether the server belongs to any of the named groups,
+// matched by title ("P2P") or identifier ("legacy_p2p").
+func inGroup(server Server, names []string) bool {
+	for _, group := range server.Groups {
+		for _, name := range names {
+			if strings.EqualFold(name, group.Title) || strings.EqualFold(name, group.Identifier) ||
+				strings.EqualFold(name, groupTitles[group.ID]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addCityStats adds the server count, average load and lowest load of each
+// city to serversByLocation.
+func addCityStats() {
+	for _, cities := range serversByLocation {
+		for _, info := range cities {
+			servers := info["servers"].([][]interface{})
+			total, minLoad := 0, 0
+			for i, entry := range servers {
+				load := entry[1].(int)
+				total += load
+				if i == 0 || load < minLoad {
+					minLoad = load
+				}
+			}
+			info["count"] = len(servers)
+			info["avg_load"] = math.Round(float64(total)/float64(len(servers))*10) / 10
+			info["min_load"] = minLoad
+		}
+	}
+}
+
+// betterServer reports whether a should replace b as the best server of a
+// city: lower load wins, then the shorter distance, then the smaller name.
+func betterServer(a, b Server) bool {
+	return byLoadDistance(&a, &b)
+}
+
+// mobileName returns a tunnel name the WireGuard mobile apps accept:
+// at most 15 characters from [a-z0-9-], e.g. "us-newyork".
+func mobileName(server Server) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(server.Locations[0].Country.Code))
+	b.WriteByte('-')
+	for _, r := range strings.ToLower(transliterate(server.Locations[0].Country.City.Name)) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		}
+	}
+	name := b.String()
+	if len(name) > 15 {
+		name = name[:15]
+	}
+	return name
+}
+
+// saveMobileBundle writes the best config of every city into a single zip.
+func saveMobileBundle(privateKey, filename string) error {
+	var best []Server
+	for _, cities := range bestConfigs {
+		for _, server := range cities {
+			best = append(best, server)
+		}
+	}
+	sort.Slice(best, func(i, j int) bool {
+		return best[i].Name < best[j].Name
+	})
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	used := make(map[string]bool)
+	for _, server := range best {
+		// Truncated names can collide, so number the duplicates
+		name := mobileName(server)
+		for i := 2; used[name]; i++ {
+			suffix := strconv.Itoa(i)
+			base := mobileName(server)
+			if len(base)+len(suffix) > 15 {
+				base = base[:15-len(suffix)]
+			}
+			name = base + suffix
+		}
+		used[name] = true
+
+		w, err := zw.Create(name + ".conf")
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write([]byte(buildConfig(privateKey, server))); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
 }
 
 func haversine(lat1, lon1, lat2, lon2 float64) float64 {
@@ -267,9 +1576,33 @@ func haversine(lat1, lon1, lat2, lon2 float64) float64 {
 	return R * c
 }
 
+// isVirtual reports whether NordVPN marks the server as a virtual location,
+// hosted outside the country it appears in.
+func isVirtual(server Server) bool {
+	for _, spec := range server.Specifications {
+		if spec.Identifier == "virtual_location" {
+			for _, v := range spec.Values {
+				if v.Value == "true" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// publicKeyTechs are the technologies that may carry the WireGuard public
+// key, in order of preference.
+var publicKeyTechs = []string{"wireguard_udp", "nordlynx"}
+
+// findPublicKey returns the server's WireGuard public key, or "" if none
+// of publicKeyTechs has one.
 func findPublicKey(server Server) string {
-	for _, tech := range server.Technologies {
-		if tech.Identifier == "wireguard_udp" {
+	for _, identifier := range publicKeyTechs {
+		for _, tech := range server.Technologies {
+			if tech.Identifier != identifier {
+				continue
+			}
 			for _, data := range tech.Metadata {
 				if data.Name == "public_key" {
 					return data.Value
@@ -279,31 +1612,3 @@ func findPublicKey(server Server) string {
 	}
 	return ""
 }
-
-type Credentials struct {
-	NordlynxPrivateKey string `json:"nordlynx_private_key"`
-}
-
-func getPrivateKey(token string) string {
-	req, err := http.NewRequest("GET", "https://api.nordvpn.com/v1/users/services/credentials", nil)
-	if err != nil {
-		fmt.Println(err)
-		return ""
-	}
-	req.SetBasicAuth("token", token)
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		fmt.Println(err)
-		return ""
-	}
-	defer resp.Body.Close()
-
-	var data Credentials
-	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
-		fmt.Println(err)
-		return ""
-	}
-
-	return data.NordlynxPrivateKey
-}
@@ -0,0 +1,1242 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setFlags parses args as the command line for the duration of the test,
+// with every other flag at its default.
+func setFlags(t *testing.T, args ...string) {
+	t.Helper()
+	old := flag.CommandLine
+	flags := flag.NewFlagSet(old.Name(), flag.ContinueOnError)
+	values := make(map[string]string)
+	old.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+		resetFlag(f, f.DefValue)
+		flags.Var(f.Value, f.Name, f.Usage)
+	})
+	flag.CommandLine = flags
+	t.Cleanup(func() {
+		flag.CommandLine = old
+		old.VisitAll(func(f *flag.Flag) {
+			resetFlag(f, values[f.Name])
+		})
+	})
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// resetFlag sets f to value, replacing rather than adding to a listFlag.
+func resetFlag(f *flag.Flag, value string) {
+	if list, ok := f.Value.(*listFlag); ok {
+		*list = nil
+	}
+	f.Value.Set(value)
+}
+
+// testServers decodes a server list written like the API's.
+func testServers(t *testing.T, body string) []Server {
+	t.Helper()
+	servers, err := decodeServers(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return servers
+}
+
+// fixtureServers is a small server list across two countries.
+const fixtureServers = `[
+	{"name":"Germany #1","hostname":"de1.nordvpn.com","station":"10.0.0.1","load":30,"status":"online",
+	 "technologies":[{"identifier":"wireguard_udp","metadata":[{"name":"public_key","value":"DE1="}]}],
+	 "locations":[{"country":{"name":"Germany","code":"DE","city":{"name":"Berlin"}},"latitude":52.52,"longitude":13.40}]},
+	{"name":"Germany #2","hostname":"de2.nordvpn.com","station":"10.0.0.2","load":10,"status":"online",
+	 "technologies":[{"identifier":"wireguard_udp","metadata":[{"name":"public_key","value":"DE2="}]}],
+	 "locations":[{"country":{"name":"Germany","code":"DE","city":{"name":"Berlin"}},"latitude":52.52,"longitude":13.40}]},
+	{"name":"Germany #3","hostname":"de3.nordvpn.com","station":"10.0.0.3","load":20,"status":"online",
+	 "technologies":[{"identifier":"wireguard_udp","metadata":[{"name":"public_key","value":"DE3="}]}],
+	 "locations":[{"country":{"name":"Germany","code":"DE","city":{"name":"Frankfurt"}},"latitude":50.11,"longitude":8.68}]},
+	{"name":"France #1","hostname":"fr1.nordvpn.com","station":"10.0.1.1","load":40,"status":"online",
+	 "technologies":[{"identifier":"wireguard_udp","metadata":[{"name":"public_key","value":"FR1="}]}],
+	 "locations":[{"country":{"name":"France","code":"FR","city":{"name":"Paris"}},"latitude":48.86,"longitude":2.35}]}
+]`
+
+// quietRun discards progress messages and restores the run state that
+// generate changes once the test is done.
+func quietRun(t *testing.T) {
+	t.Helper()
+	oldStatus, oldProgress, oldDir := status, progressOut, outDir
+	status, progressOut = io.Discard, io.Discard
+	t.Cleanup(func() {
+		status, progressOut, outDir = oldStatus, oldProgress, oldDir
+		journal, dedupIndex, writeErrors = nil, nil, nil
+	})
+}
+
+// keptServers returns the names of the servers selectServers keeps from
+// body, a server list written like the API's, sorted by load only.
+func keptServers(t *testing.T, body string) []string {
+	t.Helper()
+	return serverNames(selectServers(context.Background(), testServers(t, body), false, 0, 0))
+}
+
+// recordAll indexes servers into fresh bestConfigs and serversByLocation
+// maps, as a run does before writing servers.json.
+func recordAll(t *testing.T, servers []Server) {
+	t.Helper()
+	bestConfigs = make(map[string]map[string]Server)
+	serversByLocation = make(map[string]map[string]map[string]interface{})
+	t.Cleanup(func() {
+		bestConfigs = make(map[string]map[string]Server)
+		serversByLocation = make(map[string]map[string]map[string]interface{})
+	})
+	for _, server := range servers {
+		recordServer(server)
+	}
+	addCityStats()
+}
+
+// treeSums returns the checksum of every file under dir by relative path.
+func treeSums(t *testing.T, dir string) map[string][sha256.Size]byte {
+	t.Helper()
+	sums := make(map[string][sha256.Size]byte)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		sums[filepath.ToSlash(rel)] = sha256.Sum256(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sums
+}
+
+// serverNames lists the names of servers in order.
+func serverNames(servers []Server) []string {
+	var names []string
+	for _, server := range servers {
+		names = append(names, server.Name)
+	}
+	return names
+}
+
+func TestOutputDirName(t *testing.T) {
+	at := time.Date(2024, 3, 7, 9, 5, 1, 0, time.UTC)
+	tests := []struct {
+		pattern string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"vpn1", "vpn1", false},
+		{"configs_v2", "configs_v2", false},
+		{"nordvpn_{ts}", "nordvpn_20240307_090501", false},
+		{"runs/{date}", filepath.FromSlash("runs/2024-03-07"), false},
+		{"out_{layout:Jan2006}", "out_Mar2024", false},
+		{"{layout:2006}/{layout:01}", filepath.FromSlash("2024/03"), false},
+		{"/etc/nordvpn", "", true},
+		{"../elsewhere", "", true},
+		{"a/../../b", "", true},
+		{"bad{name}", "", true},
+		{"   ", "", true},
+	}
+	for _, tt := range tests {
+		got, err := outputDirName(tt.pattern, at)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("outputDirName(%q) = %q, %v; want %q, error %v", tt.pattern, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestAddressListNoIPv6(t *testing.T) {
+	oldAddress, oldNoIPv6 := *address, *noIPv6
+	t.Cleanup(func() { *address, *noIPv6 = oldAddress, oldNoIPv6 })
+	*address = "10.5.0.2/16, fd00::2/64"
+
+	*noIPv6 = false
+	if got := addressList(); !slices.Equal(got, []string{"10.5.0.2/16", "fd00::2/64"}) {
+		t.Errorf("addressList() = %v", got)
+	}
+	*noIPv6 = true
+	if got := addressList(); !slices.Equal(got, []string{"10.5.0.2/16"}) {
+		t.Errorf("addressList() under -no-ipv6 = %v", got)
+	}
+
+	servers, err := decodeServers(strings.NewReader(`[{"name":"A","station":"1.1.1.1","locations":[{"country":{"code":"DE","city":{"name":"Berlin"}}}]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config := buildConfig("PRIV=", servers[0]); !strings.Contains(config, "Address = 10.5.0.2/16\n") {
+		t.Errorf("IPv6 address written under -no-ipv6:\n%s", config)
+	}
+	if config := buildNMConfig("PRIV=", servers[0]); !strings.Contains(config, "[ipv6]\nmethod=disabled\n") {
+		t.Errorf("IPv6 enabled in keyfile under -no-ipv6:\n%s", config)
+	}
+
+	setFlags(t, "-no-ipv6", "-dns", "103.86.96.100, 2400:bb40:4444::100")
+	config := buildConfig("PRIV=", servers[0])
+	if !strings.Contains(config, "AllowedIPs = 0.0.0.0/0\n") {
+		t.Errorf("::/0 left in AllowedIPs under -no-ipv6:\n%s", config)
+	}
+	if !strings.Contains(config, "DNS = 103.86.96.100\n") {
+		t.Errorf("IPv6 DNS server kept under -no-ipv6:\n%s", config)
+	}
+	setFlags(t, "-no-ipv6", "-dns", "2400:bb40:4444::100")
+	if err := validateFlags(); err == nil {
+		t.Error("-no-ipv6 accepted a DNS list of IPv6 servers only")
+	}
+}
+
+func TestClearOutput(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"configs/Germany/Berlin/gone.conf", "servers.json", "notes.txt"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := clearOutput(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "configs")); !os.IsNotExist(err) {
+		t.Error("configs of the previous run were kept")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "servers.json")); !os.IsNotExist(err) {
+		t.Error("servers.json of the previous run was kept")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Error("a file the run didn't write was removed")
+	}
+
+	if err := os.Mkdir(filepath.Join(dir, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := clearOutput(dir); err == nil {
+		t.Error("clearOutput cleared a git checkout")
+	}
+}
+
+func TestIPv6Only(t *testing.T) {
+	setFlags(t, "-ipv6-only")
+	if err := validateFlags(); err == nil {
+		t.Error("-ipv6-only accepted the default IPv4 DNS server")
+	}
+
+	setFlags(t, "-ipv6-only", "-dns", "2400:bb40:4444::100")
+	if err := validateFlags(); err != nil {
+		t.Fatal(err)
+	}
+	servers := testServers(t, `[{"name":"A","station":"1.1.1.1","locations":[{"country":{"code":"DE","city":{"name":"Berlin"}}}]}]`)
+	config := buildConfig("PRIV=", servers[0])
+	for _, line := range []string{"Address = fd00::2/64\n", "DNS = 2400:bb40:4444::100\n", "AllowedIPs = ::/0\n"} {
+		if !strings.Contains(config, line) {
+			t.Errorf("config under -ipv6-only is missing %q:\n%s", line, config)
+		}
+	}
+	keyfile := buildNMConfig("PRIV=", servers[0])
+	if !strings.Contains(keyfile, "[ipv6]\naddress1=fd00::2/64\ndns=2400:bb40:4444::100;\n") {
+		t.Errorf("keyfile under -ipv6-only lost the IPv6 address or DNS:\n%s", keyfile)
+	}
+}
+
+func TestGenerateStableRunsMatch(t *testing.T) {
+	setFlags(t, "-stable", "-no-geo", "-csv")
+	quietRun(t)
+
+	first, second := t.TempDir(), t.TempDir()
+	// A server that has since disappeared must not survive the second run
+	gone := filepath.Join(second, "configs", "Spain", "Madrid", "Spain_1.conf")
+	if err := os.MkdirAll(filepath.Dir(gone), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(gone, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{first, second} {
+		servers := selectServers(context.Background(), testServers(t, fixtureServers), false, 0, 0)
+		if _, err := generate(context.Background(), "PRIV=", servers, dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, b := treeSums(t, first), treeSums(t, second)
+	if len(a) != 9 {
+		t.Errorf("first run wrote %d files, want 4 configs, 3 best configs, servers.json and servers.csv", len(a))
+	}
+	if len(a) != len(b) {
+		t.Errorf("runs wrote %d and %d files", len(a), len(b))
+	}
+	for path, sum := range a {
+		if b[path] != sum {
+			t.Errorf("%s differs between the runs", path)
+		}
+	}
+}
+
+func TestMobileBundle(t *testing.T) {
+	setFlags(t, "-mobile-bundle", "-no-geo")
+	quietRun(t)
+	servers := testServers(t, `[
+		{"name":"Germany #2","station":"10.0.0.2","load":10,"locations":[{"country":{"name":"Germany","code":"DE","city":{"name":"Berlin"}}}]},
+		{"name":"Germany #1","station":"10.0.0.1","load":30,"locations":[{"country":{"name":"Germany","code":"DE","city":{"name":"Berlin"}}}]},
+		{"name":"United States #1","station":"10.0.1.1","locations":[{"country":{"name":"United States","code":"US","city":{"name":"San Francisco Bay"}}}]},
+		{"name":"United States #2","station":"10.0.1.2","locations":[{"country":{"name":"United States","code":"US","city":{"name":"San Francisco Bay Area"}}}]}
+	]`)
+	dir := t.TempDir()
+	if _, err := generate(context.Background(), "PRIV=", servers, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.OpenReader(filepath.Join(dir, "nordvpn_mobile.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		if f.Name == "de-berlin.conf" {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := io.ReadAll(rc)
+			rc.Close()
+			if !strings.Contains(string(data), "Endpoint = 10.0.0.2:51820") {
+				t.Errorf("de-berlin.conf isn't the city's least loaded server:\n%s", data)
+			}
+		}
+	}
+	// One config per city, truncated names that collide are numbered
+	want := []string{"de-berlin.conf", "us-sanfrancisco.conf", "us-sanfrancisc2.conf"}
+	if !slices.Equal(names, want) {
+		t.Errorf("bundle holds %v, want %v", names, want)
+	}
+}
+
+func TestLocateAutoCountry(t *testing.T) {
+	setFlags(t, "-auto-country", "-no-geo")
+	quietRun(t)
+	serveLocation(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"loc":"48.86,2.35","country":"FR"}`))
+	})
+
+	if _, _, _, err := locate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if *countryFilter != "FR" {
+		t.Fatalf("-country = %q after the lookup, want FR", *countryFilter)
+	}
+	servers := selectServers(context.Background(), testServers(t, fixtureServers), false, 0, 0)
+	if len(servers) != 1 || servers[0].Name != "France #1" {
+		t.Errorf("kept %v, want only the server in France", serverNames(servers))
+	}
+
+	serveLocation(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"loc":"48.86,2.35"}`))
+	})
+	if _, _, _, err := locate(context.Background()); err == nil {
+		t.Error("-auto-country accepted a lookup without a country")
+	}
+}
+
+func TestLocateSkipsLookup(t *testing.T) {
+	quietRun(t)
+	var lookups atomic.Int32
+	serveLocation(t, func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		w.Write([]byte(`{"loc":"48.86,2.35","country":"FR"}`))
+	})
+
+	setFlags(t, "-lat", "50.11", "-lon", "8.68")
+	geo, lat, lon, err := locate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !geo || lat != 50.11 || lon != 8.68 {
+		t.Errorf("-lat/-lon located at %v, %v (geo %v), want 50.11, 8.68", lat, lon, geo)
+	}
+
+	setFlags(t, "-no-geo", "-sort", "distance")
+	geo, lat, lon, err = locate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if geo {
+		t.Error("-no-geo still sorts by distance")
+	}
+	if n := lookups.Load(); n != 0 {
+		t.Errorf("location looked up %d times, want none", n)
+	}
+	servers := selectServers(context.Background(), testServers(t, fixtureServers), geo, lat, lon)
+	want := []string{"Germany #2", "Germany #3", "Germany #1", "France #1"}
+	if got := serverNames(servers); !slices.Equal(got, want) {
+		t.Errorf("-no-geo order = %v, want %v", got, want)
+	}
+	for _, server := range servers {
+		if server.Distance != 0 {
+			t.Errorf("%s has distance %v under -no-geo, want 0", server.Name, server.Distance)
+		}
+	}
+}
+
+func TestFailedLocationSortsByLoad(t *testing.T) {
+	setFlags(t, "-sort", "distance", "-retries", "0", "-limit", "2")
+	quietRun(t)
+	serveLocation(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	geo, lat, lon, err := locate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if geo {
+		t.Fatal("a failed lookup still sorts by distance")
+	}
+	servers := selectServers(context.Background(), testServers(t, fixtureServers), geo, lat, lon)
+	want := []string{"Germany #2", "Germany #3", "Germany #1", "France #1"}
+	if got := serverNames(servers); !slices.Equal(got, want) {
+		t.Errorf("order = %v, want %v", got, want)
+	}
+
+	dir := t.TempDir()
+	if _, err := generate(context.Background(), "PRIV=", servers, dir); err != nil {
+		t.Fatal(err)
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "configs", "*", "*", "*.conf"))
+	if len(matches) != 2 || !strings.HasSuffix(matches[0], "Germany_2.conf") || !strings.HasSuffix(matches[1], "Germany_3.conf") {
+		t.Errorf("-limit 2 wrote %v, want the two least loaded servers", matches)
+	}
+}
+
+func TestGenerateStopsWhenCancelled(t *testing.T) {
+	setFlags(t, "-no-geo")
+	quietRun(t)
+	servers := selectServers(context.Background(), testServers(t, fixtureServers), false, 0, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dir := t.TempDir()
+	if _, err := generate(ctx, "PRIV=", servers, dir); !errors.Is(err, context.Canceled) {
+		t.Fatalf("generate after cancelling = %v, want %v", err, context.Canceled)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "configs")); !os.IsNotExist(err) {
+		t.Error("configs were written after cancelling")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "servers.json")); !os.IsNotExist(err) {
+		t.Error("servers.json was written after cancelling")
+	}
+}
+
+func TestSortServers(t *testing.T) {
+	tests := []struct {
+		sort string
+		want []string
+	}{
+		{"load", []string{"Germany #2", "Germany #3", "Germany #1", "France #1"}},
+		{"distance", []string{"Germany #3", "Germany #2", "Germany #1", "France #1"}},
+		{"name", []string{"France #1", "Germany #1", "Germany #2", "Germany #3"}},
+		{"city", []string{"France #1", "Germany #2", "Germany #1", "Germany #3"}},
+	}
+	for _, tt := range tests {
+		setFlags(t, "-sort", tt.sort)
+		servers := testServers(t, fixtureServers)
+		sortServers(servers, true, 50.11, 8.68) // Frankfurt
+		if got := serverNames(servers); !slices.Equal(got, tt.want) {
+			t.Errorf("-sort %s: %v, want %v", tt.sort, got, tt.want)
+		}
+	}
+}
+
+func TestCheckOutputDir(t *testing.T) {
+	setFlags(t)
+	empty, missing := t.TempDir(), filepath.Join(t.TempDir(), "new")
+	for _, dir := range []string{empty, missing} {
+		if err := checkOutputDir(dir); err != nil {
+			t.Errorf("checkOutputDir(%s) = %v, want nil", dir, err)
+		}
+	}
+
+	used := t.TempDir()
+	if err := os.WriteFile(filepath.Join(used, "notes.txt"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkOutputDir(used); err == nil {
+		t.Error("checkOutputDir accepted a non-empty directory")
+	}
+	setFlags(t, "-force")
+	if err := checkOutputDir(used); err != nil {
+		t.Errorf("checkOutputDir with -force = %v, want nil", err)
+	}
+
+	// -force doesn't cover a git checkout or the run being compared with
+	checkout := t.TempDir()
+	if err := os.Mkdir(filepath.Join(checkout, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkOutputDir(checkout); err == nil {
+		t.Error("checkOutputDir accepted a git checkout")
+	}
+	setFlags(t, "-force", "-diff", empty)
+	if err := checkOutputDir(empty); err == nil {
+		t.Error("checkOutputDir accepted the -diff directory")
+	}
+}
+
+// TestSaveConfigsCounts hits the counters from many writers at once while
+// the progress line reads them; run it with -race.
+func TestSaveConfigsCounts(t *testing.T) {
+	setFlags(t, "-concurrency", "50")
+	quietRun(t)
+	outDir = t.TempDir()
+	stats = runStats{}
+	servers, err := decodeServers(bytes.NewReader(serverFixture(500)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := startProgress(io.Discard, len(servers))
+	saveConfigs(context.Background(), "PRIV=", servers)
+	stop()
+	if n := stats.written.Load(); n != 500 {
+		t.Errorf("counted %d written configs, want 500", n)
+	}
+	if n := stats.failed.Load() + stats.skipped.Load() + stats.duplicates.Load(); n != 0 {
+		t.Errorf("counted %d other configs, want 0", n)
+	}
+}
+
+func TestSaveConfigsConcurrencyLimit(t *testing.T) {
+	setFlags(t, "-concurrency", "8")
+	quietRun(t)
+	outDir = t.TempDir()
+	var inFlight, peak atomic.Int64
+	old := writeFile
+	writeFile = func(name string, data []byte, perm os.FileMode) error {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}
+	t.Cleanup(func() { writeFile = old })
+	servers, err := decodeServers(bytes.NewReader(serverFixture(64)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saveConfigs(context.Background(), "PRIV=", servers)
+	if n := peak.Load(); n != 8 {
+		t.Errorf("at most %d writes were in flight, want -concurrency 8", n)
+	}
+}
+
+func TestGenerateLocality(t *testing.T) {
+	setFlags(t, "-no-geo", "-locality")
+	quietRun(t)
+	servers := selectServers(context.Background(), testServers(t, fixtureServers), false, 0, 0)
+
+	groups := groupByCountry(servers)
+	if len(groups) != 2 || len(groups[0]) != 3 || len(groups[1]) != 1 {
+		t.Fatalf("groupByCountry split the servers into %d groups", len(groups))
+	}
+	dir := t.TempDir()
+	if _, err := generate(context.Background(), "PRIV=", servers, dir); err != nil {
+		t.Fatal(err)
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "configs", "*", "*", "*.conf"))
+	if len(matches) != len(servers) {
+		t.Errorf("-locality wrote %d of %d configs", len(matches), len(servers))
+	}
+}
+
+func BenchmarkSaveConfigs(b *testing.B) {
+	servers, err := decodeServers(bytes.NewReader(serverFixture(2000)))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := range servers {
+		servers[i].Locations[0].Country.Name = fmt.Sprintf("Country %d", i%60)
+	}
+	oldStatus := status
+	status = io.Discard
+	b.Cleanup(func() { status, outDir = oldStatus, "" })
+
+	b.Run("all", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			outDir = b.TempDir()
+			saveConfigs(context.Background(), "PRIV=", servers)
+		}
+	})
+	b.Run("locality", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			outDir = b.TempDir()
+			for _, group := range groupByCountry(servers) {
+				saveConfigs(context.Background(), "PRIV=", group)
+			}
+		}
+	})
+}
+
+func TestValidateDNS(t *testing.T) {
+	tests := []struct {
+		list    string
+		wantErr bool
+	}{
+		{"103.86.96.100", false},
+		{"2400:bb40:4444::100", false},
+		{"dns.example.com", false},
+		{"1.1.1.1, 2606:4700:4700::1111, dns.example.com", false},
+		{"none", false},
+		{"1.1.1.1, 300.1.1.1", true},
+		{"1.1.1", true},
+		{"bad_host!", true},
+		{"", true},
+	}
+	for _, tt := range tests {
+		if err := validateDNS(tt.list); (err != nil) != tt.wantErr {
+			t.Errorf("validateDNS(%q) = %v, want error %v", tt.list, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+	}{
+		{"1.1.1.1,1.0.0.1", []string{"1.1.1.1", "1.0.0.1"}},
+		{"1.1.1.1, 1.0.0.1,", []string{"1.1.1.1", "1.0.0.1"}},
+		{"1.1.1.1,,1.0.0.1", []string{"1.1.1.1", "1.0.0.1"}},
+		{"  1.1.1.1 ,\t1.0.0.1  ", []string{"1.1.1.1", "1.0.0.1"}},
+		{" , ,", nil},
+	}
+	for _, tt := range tests {
+		if got := splitList(tt.list); !slices.Equal(got, tt.want) {
+			t.Errorf("splitList(%q) = %q, want %q", tt.list, got, tt.want)
+		}
+		if tt.want != nil {
+			if err := validateDNS(tt.list); err != nil {
+				t.Errorf("validateDNS(%q) = %v", tt.list, err)
+			}
+		}
+	}
+}
+
+func TestEndpointHost(t *testing.T) {
+	servers := testServers(t, `[{"name":"A","hostname":"de1.nordvpn.com","station":"10.0.0.1","ipv6_station":"2a00::1"}]`)
+	resolvedMu.Lock()
+	resolvedIPs["de1.nordvpn.com"] = "192.0.2.1"
+	resolvedMu.Unlock()
+	t.Cleanup(func() {
+		resolvedMu.Lock()
+		delete(resolvedIPs, "de1.nordvpn.com")
+		resolvedMu.Unlock()
+	})
+
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, "10.0.0.1"},
+		{[]string{"-endpoint", "station"}, "10.0.0.1"},
+		{[]string{"-endpoint", "hostname"}, "de1.nordvpn.com"},
+		{[]string{"-endpoint", "ip"}, "192.0.2.1"},
+		{[]string{"-endpoint", "hostname", "-endpoint-suffix", "vpn.internal"}, "de1.vpn.internal"},
+		{[]string{"-endpoint", "hostname", "-endpoint-suffix", ".vpn.internal"}, "de1.vpn.internal"},
+		{[]string{"-endpoint", "station6"}, "[2a00::1]"},
+	}
+	for _, tt := range tests {
+		setFlags(t, tt.args...)
+		if got := endpointHost(servers[0]); got != tt.want {
+			t.Errorf("endpointHost with %v = %q, want %q", tt.args, got, tt.want)
+		}
+		if config := buildConfig("PRIV=", servers[0]); !strings.Contains(config, "Endpoint = "+tt.want+":51820\n") {
+			t.Errorf("config with %v doesn't use endpoint %s:\n%s", tt.args, tt.want, config)
+		}
+	}
+
+	// Without an IPv6 station the hostname is used, then the station
+	setFlags(t, "-endpoint", "station6")
+	noV6 := testServers(t, `[{"name":"B","hostname":"de2.nordvpn.com","station":"10.0.0.2"},{"name":"C","station":"10.0.0.3"}]`)
+	if got := endpointHost(noV6[0]); got != "de2.nordvpn.com" {
+		t.Errorf("station6 without an IPv6 station = %q, want the hostname", got)
+	}
+	if got := endpointHost(noV6[1]); got != "10.0.0.3" {
+		t.Errorf("station6 without an IPv6 station or hostname = %q, want the station", got)
+	}
+}
+
+func TestEndpointSuffixValidation(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr bool
+	}{
+		{[]string{"-endpoint", "hostname", "-endpoint-suffix", "vpn.internal"}, false},
+		{[]string{"-endpoint", "hostname", "-endpoint-suffix", ".vpn.internal"}, false},
+		{[]string{"-endpoint", "hostname", "-endpoint-suffix", "bad_suffix"}, true},
+		{[]string{"-endpoint", "hostname", "-endpoint-suffix", "a..b"}, true},
+		{[]string{"-endpoint", "station", "-endpoint-suffix", "vpn.internal"}, true},
+	}
+	for _, tt := range tests {
+		setFlags(t, tt.args...)
+		if err := validateFlags(); (err != nil) != tt.wantErr {
+			t.Errorf("validateFlags with %v = %v, want error %v", tt.args, err, tt.wantErr)
+		}
+	}
+}
+
+func TestBetterServerPrefersCloserAtEqualLoad(t *testing.T) {
+	near := Server{Name: "Germany #9", Load: 20, Distance: 100}
+	far := Server{Name: "Germany #1", Load: 20, Distance: 400}
+	if !betterServer(near, far) || betterServer(far, near) {
+		t.Error("at equal load the closer server doesn't win")
+	}
+	busy := Server{Name: "Germany #5", Load: 21, Distance: 1}
+	if betterServer(busy, far) {
+		t.Error("a busier server won for being closer")
+	}
+	twin := Server{Name: "Germany #2", Load: 20, Distance: 100}
+	if betterServer(twin, near) == betterServer(near, twin) {
+		t.Error("a full tie isn't broken by name")
+	}
+}
+
+func TestSaveServersCSV(t *testing.T) {
+	servers := testServers(t, fixtureServers)[:1]
+	servers[0].Distance = 421.6
+	file := filepath.Join(t.TempDir(), "servers.csv")
+	if err := saveServersCSV(file, servers); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"name", "country", "city", "code", "load", "distance_km", "hostname", "station"},
+		{"Germany #1", "Germany", "Berlin", "de", "30", "422", "de1.nordvpn.com", "10.0.0.1"},
+	}
+	if len(rows) != len(want) {
+		t.Fatalf("got %d rows, want %d", len(rows), len(want))
+	}
+	for i := range want {
+		if !slices.Equal(rows[i], want[i]) {
+			t.Errorf("row %d = %q, want %q", i, rows[i], want[i])
+		}
+	}
+}
+
+func TestAllowedIPListDNSInTunnel(t *testing.T) {
+	server := testServers(t, fixtureServers)[0]
+	dnsServers := "103.86.96.100, 10.1.1.1, 2400:bb40::1, dns.example.com"
+
+	setFlags(t, "-allowed-ips", "10.0.0.0/8", "-dns", dnsServers)
+	if got := allowedIPList(server); !slices.Equal(got, []string{"10.0.0.0/8"}) {
+		t.Errorf("AllowedIPs without -dns-in-tunnel = %v", got)
+	}
+	// 10.1.1.1 is already routed and a hostname can't be
+	setFlags(t, "-allowed-ips", "10.0.0.0/8", "-dns", dnsServers, "-dns-in-tunnel")
+	want := []string{"10.0.0.0/8", "103.86.96.100/32", "2400:bb40::1/128"}
+	if got := allowedIPList(server); !slices.Equal(got, want) {
+		t.Errorf("AllowedIPs with -dns-in-tunnel = %v, want %v", got, want)
+	}
+	setFlags(t, "-dns", dnsServers, "-dns-in-tunnel")
+	if got := allowedIPList(server); !slices.Equal(got, []string{"0.0.0.0/0", "::/0"}) {
+		t.Errorf("full tunnel with -dns-in-tunnel = %v, want no extra routes", got)
+	}
+}
+
+func TestMarshalServersCompact(t *testing.T) {
+	recordAll(t, testServers(t, fixtureServers))
+	compact, err := marshalServers(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indented, err := marshalServers(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.ContainsRune(compact, '\n') {
+		t.Errorf("compact servers.json has newlines:\n%s", compact)
+	}
+	if len(compact) >= len(indented) {
+		t.Errorf("compact servers.json is %d bytes, indented %d", len(compact), len(indented))
+	}
+	var a, b interface{}
+	if err := json.Unmarshal(compact, &a); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(indented, &b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(a, b) {
+		t.Error("compact and indented servers.json hold different data")
+	}
+}
+
+func TestAddCityStats(t *testing.T) {
+	recordAll(t, testServers(t, `[
+		{"name":"Germany #1","load":30,"locations":[{"country":{"name":"Germany","code":"DE","city":{"name":"Berlin"}}}]},
+		{"name":"Germany #2","load":10,"locations":[{"country":{"name":"Germany","code":"DE","city":{"name":"Berlin"}}}]},
+		{"name":"Germany #3","load":25,"locations":[{"country":{"name":"Germany","code":"DE","city":{"name":"Berlin"}}}]},
+		{"name":"France #1","load":40,"locations":[{"country":{"name":"France","code":"FR","city":{"name":"Paris"}}}]}
+	]`))
+
+	tests := []struct {
+		country, city string
+		count         int
+		avgLoad       float64
+		minLoad       int
+	}{
+		{"Germany", "Berlin", 3, 21.7, 10},
+		{"France", "Paris", 1, 40, 40},
+	}
+	for _, tt := range tests {
+		info := serversByLocation[tt.country][tt.city]
+		if info["count"] != tt.count || info["avg_load"] != tt.avgLoad || info["min_load"] != tt.minLoad {
+			t.Errorf("%s/%s: count %v, avg_load %v, min_load %v; want %d, %v, %d",
+				tt.country, tt.city, info["count"], info["avg_load"], info["min_load"], tt.count, tt.avgLoad, tt.minLoad)
+		}
+	}
+}
+
+func TestGroupLabels(t *testing.T) {
+	serveAPI(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id":15,"title":"P2P","identifier":"legacy_p2p"},{"id":11,"title":"Standard VPN servers","identifier":"legacy_standard"}]`))
+	})
+	groups, err := getGroups(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupTitles = make(map[int]string)
+	t.Cleanup(func() { groupTitles = nil })
+	for _, group := range groups {
+		groupTitles[group.ID] = group.Title
+	}
+
+	// Servers may carry ids only, or titles the groups list renamed
+	recordAll(t, testServers(t, `[
+		{"name":"Germany #1","load":10,"groups":[{"id":15},{"id":11,"title":"Standard"}],"locations":[{"country":{"name":"Germany","code":"DE","city":{"name":"Berlin"}}}]},
+		{"name":"Germany #2","load":20,"groups":[{"id":99,"title":"Unlisted"}],"locations":[{"country":{"name":"Germany","code":"DE","city":{"name":"Berlin"}}}]},
+		{"name":"Germany #3","load":30,"locations":[{"country":{"name":"Germany","code":"DE","city":{"name":"Berlin"}}}]}
+	]`))
+	entries := serversByLocation["Germany"]["Berlin"]["servers"].([][]interface{})
+	if len(entries) != 3 {
+		t.Fatalf("Berlin lists %d servers, want 3", len(entries))
+	}
+	want := [][]string{{"P2P", "Standard VPN servers"}, {"Unlisted"}, {}}
+	for i, entry := range entries {
+		if labels := entry[2].([]string); !slices.Equal(labels, want[i]) {
+			t.Errorf("%s has labels %q, want %q", entry[0], labels, want[i])
+		}
+	}
+}
+
+func TestGroupFilter(t *testing.T) {
+	quietRun(t)
+	body := `[
+		{"name":"P2P #1","load":10,"groups":[{"id":15,"title":"P2P","identifier":"legacy_p2p"}],
+		 "technologies":[{"identifier":"wireguard_udp","metadata":[{"name":"public_key","value":"A="}]}],
+		 "locations":[{"country":{"name":"Germany","code":"DE","city":{"name":"Berlin"}}}]},
+		{"name":"Standard #1","load":20,"groups":[{"id":11,"title":"Standard VPN servers","identifier":"legacy_standard"}],
+		 "technologies":[{"identifier":"wireguard_udp","metadata":[{"name":"public_key","value":"B="}]}],
+		 "locations":[{"country":{"name":"Germany","code":"DE","city":{"name":"Berlin"}}}]}
+	]`
+	for _, name := range []string{"P2P", "p2p", "legacy_p2p"} {
+		setFlags(t, "-group", name)
+		if got := keptServers(t, body); !slices.Equal(got, []string{"P2P #1"}) {
+			t.Errorf("-group %s kept %v, want only the P2P server", name, got)
+		}
+	}
+	setFlags(t)
+	if got := keptServers(t, body); len(got) != 2 {
+		t.Errorf("without -group kept %v, want both", got)
+	}
+}
+
+func TestCountryLists(t *testing.T) {
+	quietRun(t)
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"-include-country", "fr"}, []string{"France #1"}},
+		{[]string{"-include-country", "France", "-include-country", "de"}, []string{"Germany #2", "Germany #3", "Germany #1", "France #1"}},
+		{[]string{"-exclude-country", "Germany"}, []string{"France #1"}},
+		{[]string{"-exclude-country", "de,FR"}, nil},
+	}
+	for _, tt := range tests {
+		setFlags(t, tt.args...)
+		if got := keptServers(t, fixtureServers); !slices.Equal(got, tt.want) {
+			t.Errorf("%v kept %v, want %v", tt.args, got, tt.want)
+		}
+	}
+
+	setFlags(t, "-include-country", "de", "-exclude-country", "fr")
+	if err := validateFlags(); err == nil {
+		t.Error("-include-country and -exclude-country were accepted together")
+	}
+}
+
+func TestCountryFilterCodeOrName(t *testing.T) {
+	quietRun(t)
+	body := `[
+		{"name":"United States #1","load":10,"technologies":[{"identifier":"wireguard_udp","metadata":[{"name":"public_key","value":"A="}]}],
+		 "locations":[{"country":{"name":"United States","code":"US","city":{"name":"New York"}}}]},
+		{"name":"Germany #1","load":20,"technologies":[{"identifier":"wireguard_udp","metadata":[{"name":"public_key","value":"B="}]}],
+		 "locations":[{"country":{"name":"Germany","code":"DE","city":{"name":"Berlin"}}}]}
+	]`
+	for _, query := range []string{"us", "US", "United States", "united states", "United_States", " us "} {
+		setFlags(t, "-country", query)
+		if got := keptServers(t, body); !slices.Equal(got, []string{"United States #1"}) {
+			t.Errorf("-country %q kept %v, want only the US server", query, got)
+		}
+	}
+	setFlags(t, "-country", "United")
+	if got := keptServers(t, body); got != nil {
+		t.Errorf("-country United kept %v, want none", got)
+	}
+}
+
+func TestMaxLoad(t *testing.T) {
+	quietRun(t)
+	tests := []struct {
+		maxLoad string
+		want    []string
+	}{
+		{"30", []string{"Germany #2", "Germany #3", "Germany #1"}}, // exactly at the threshold is kept
+		{"29", []string{"Germany #2", "Germany #3"}},
+		{"100", []string{"Germany #2", "Germany #3", "Germany #1", "France #1"}},
+	}
+	for _, tt := range tests {
+		setFlags(t, "-max-load", tt.maxLoad)
+		if got := keptServers(t, fixtureServers); !slices.Equal(got, tt.want) {
+			t.Errorf("-max-load %s kept %v, want %v", tt.maxLoad, got, tt.want)
+		}
+	}
+}
+
+func TestNameContains(t *testing.T) {
+	quietRun(t)
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"germany", []string{"Germany #2", "Germany #3", "Germany #1"}},
+		{"FRANCE", []string{"France #1"}},
+		{"Germany #3", []string{"Germany #3"}},
+		{"Spain", nil},
+	}
+	for _, tt := range tests {
+		setFlags(t, "-name-contains", tt.query)
+		if got := keptServers(t, fixtureServers); !slices.Equal(got, tt.want) {
+			t.Errorf("-name-contains %q kept %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestMinDistance(t *testing.T) {
+	quietRun(t)
+	// From Frankfurt: Germany #3 is there, Berlin is about 420km and Paris 480km away
+	tests := []struct {
+		minDistance string
+		want        []string
+	}{
+		{"0", []string{"Germany #2", "Germany #3", "Germany #1", "France #1"}},
+		{"100", []string{"Germany #2", "Germany #1", "France #1"}},
+		{"450", []string{"France #1"}},
+		{"1000", nil},
+	}
+	for _, tt := range tests {
+		setFlags(t, "-min-distance", tt.minDistance)
+		servers := selectServers(context.Background(), testServers(t, fixtureServers), true, 50.11, 8.68)
+		if got := serverNames(servers); !slices.Equal(got, tt.want) {
+			t.Errorf("-min-distance %s kept %v, want %v", tt.minDistance, got, tt.want)
+		}
+	}
+}
+
+func TestMaxDistance(t *testing.T) {
+	quietRun(t)
+	tests := []struct {
+		maxDistance string
+		want        []string
+	}{
+		{"0", []string{"Germany #2", "Germany #3", "Germany #1", "France #1"}}, // no limit
+		{"1000", []string{"Germany #2", "Germany #3", "Germany #1", "France #1"}},
+		{"450", []string{"Germany #2", "Germany #3", "Germany #1"}},
+		{"100", []string{"Germany #3"}},
+	}
+	for _, tt := range tests {
+		setFlags(t, "-max-distance", tt.maxDistance)
+		servers := selectServers(context.Background(), testServers(t, fixtureServers), true, 50.11, 8.68)
+		if got := serverNames(servers); !slices.Equal(got, tt.want) {
+			t.Errorf("-max-distance %s kept %v, want %v", tt.maxDistance, got, tt.want)
+		}
+	}
+}
+
+func TestIncludeOffline(t *testing.T) {
+	quietRun(t)
+	body := `[
+		{"name":"Online #1","load":10,"status":"online","technologies":[{"identifier":"wireguard_udp","metadata":[{"name":"public_key","value":"A="}]}],
+		 "locations":[{"country":{"name":"Germany","code":"DE","city":{"name":"Berlin"}}}]},
+		{"name":"Offline #1","load":20,"status":"offline","technologies":[{"identifier":"wireguard_udp","metadata":[{"name":"public_key","value":"B="}]}],
+		 "locations":[{"country":{"name":"Germany","code":"DE","city":{"name":"Berlin"}}}]},
+		{"name":"Maintenance #1","load":30,"status":"maintenance","technologies":[{"identifier":"wireguard_udp","metadata":[{"name":"public_key","value":"C="}]}],
+		 "locations":[{"country":{"name":"Germany","code":"DE","city":{"name":"Berlin"}}}]},
+		{"name":"Unknown #1","load":40,"technologies":[{"identifier":"wireguard_udp","metadata":[{"name":"public_key","value":"D="}]}],
+		 "locations":[{"country":{"name":"Germany","code":"DE","city":{"name":"Berlin"}}}]}
+	]`
+	setFlags(t)
+	// A missing status isn't taken as offline
+	if got, want := keptServers(t, body), []string{"Online #1", "Unknown #1"}; !slices.Equal(got, want) {
+		t.Errorf("kept %v by default, want %v", got, want)
+	}
+	setFlags(t, "-include-offline")
+	if got, want := keptServers(t, body), []string{"Online #1", "Offline #1", "Maintenance #1", "Unknown #1"}; !slices.Equal(got, want) {
+		t.Errorf("-include-offline kept %v, want %v", got, want)
+	}
+}
+
+func TestRejectReasons(t *testing.T) {
+	setFlags(t, "-verbose", "-name-contains", "keep", "-country", "DE", "-group", "P2P",
+		"-physical-only", "-max-load", "50", "-max-distance", "1000")
+	quietRun(t)
+	var out bytes.Buffer
+	status = &out
+
+	type fixture struct {
+		name, status, group, virtual, key, location string
+		load                                        int
+	}
+	berlin := `[{"country":{"name":"Germany","code":"DE","city":{"name":"Berlin"}},"latitude":52.52,"longitude":13.40}]`
+	good := fixture{"Good keep", "online", "P2P", "false", "KEY=", berlin, 10}
+	servers := []fixture{good}
+	change := func(name string, edit func(*fixture)) {
+		f := good
+		f.name = name
+		edit(&f)
+		servers = append(servers, f)
+	}
+	change("NoLoc keep", func(f *fixture) { f.location = `[]` })
+	change("NoCode keep", func(f *fixture) { f.location = `[{"country":{"name":"Germany","city":{"name":"Berlin"}}}]` })
+	change("NoKey keep", func(f *fixture) { f.key = "" })
+	change("Good keep", func(f *fixture) { f.load = 20 })
+	change("Offline keep", func(f *fixture) { f.status = "maintenance" })
+	change("Other", func(f *fixture) {})
+	change("France keep", func(f *fixture) {
+		f.location = `[{"country":{"name":"France","code":"FR","city":{"name":"Paris"}},"latitude":48.86,"longitude":2.35}]`
+	})
+	change("Standard keep", func(f *fixture) { f.group = "Standard VPN servers" })
+	change("Virtual keep", func(f *fixture) { f.virtual = "true" })
+	change("Busy keep", func(f *fixture) { f.load = 51 })
+	change("Far keep", func(f *fixture) {
+		f.location = `[{"country":{"name":"Germany","code":"DE","city":{"name":"Far"}},"latitude":0,"longitude":0}]`
+	})
+
+	var entries []string
+	for _, f := range servers {
+		tech := `[]`
+		if f.key != "" {
+			tech = fmt.Sprintf(`[{"identifier":"wireguard_udp","metadata":[{"name":"public_key","value":%q}]}]`, f.key)
+		}
+		entries = append(entries, fmt.Sprintf(`{"name":%q,"status":%q,"load":%d,"groups":[{"title":%q}],`+
+			`"specifications":[{"identifier":"virtual_location","values":[{"value":%q}]}],"technologies":%s,"locations":%s}`,
+			f.name, f.status, f.load, f.group, f.virtual, tech, f.location))
+	}
+	kept := selectServers(context.Background(), testServers(t, "["+strings.Join(entries, ",")+"]"), true, 52.52, 13.40)
+	if names := serverNames(kept); !slices.Equal(names, []string{"Good keep"}) {
+		t.Errorf("kept %v, want only Good keep", names)
+	}
+
+	for _, line := range []string{
+		"skipped NoLoc keep: no-location",
+		"skipped NoCode keep: no-country-code",
+		"skipped NoKey keep: no-pubkey",
+		"skipped Good keep: duplicate",
+		"skipped Offline keep: offline",
+		"skipped Other: name-filter",
+		"skipped France keep: country-filter",
+		"skipped Standard keep: group-filter",
+		"skipped Virtual keep: virtual-filter",
+		"skipped Busy keep: load",
+		"skipped Far keep: distance",
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("-verbose output is missing %q", line)
+		}
+	}
+}
+
+func TestVirtualFilters(t *testing.T) {
+	quietRun(t)
+	body := `[
+		{"name":"Virtual #1","load":10,"specifications":[{"identifier":"virtual_location","values":[{"value":"true"}]}],
+		 "technologies":[{"identifier":"wireguard_udp","metadata":[{"name":"public_key","value":"A="}]}],
+		 "locations":[{"country":{"name":"Bahamas","code":"BS","city":{"name":"Nassau"}}}]},
+		{"name":"Physical #1","load":20,"specifications":[{"identifier":"virtual_location","values":[{"value":"false"}]}],
+		 "technologies":[{"identifier":"wireguard_udp","metadata":[{"name":"public_key","value":"B="}]}],
+		 "locations":[{"country":{"name":"Germany","code":"DE","city":{"name":"Berlin"}}}]},
+		{"name":"Unmarked #1","load":30,
+		 "technologies":[{"identifier":"wireguard_udp","metadata":[{"name":"public_key","value":"C="}]}],
+		 "locations":[{"country":{"name":"Germany","code":"DE","city":{"name":"Berlin"}}}]}
+	]`
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{nil, []string{"Virtual #1", "Physical #1", "Unmarked #1"}},
+		{[]string{"-virtual-only"}, []string{"Virtual #1"}},
+		{[]string{"-physical-only"}, []string{"Physical #1", "Unmarked #1"}},
+	}
+	for _, tt := range tests {
+		setFlags(t, tt.args...)
+		if got := keptServers(t, body); !slices.Equal(got, tt.want) {
+			t.Errorf("%v kept %v, want %v", tt.args, got, tt.want)
+		}
+	}
+
+	setFlags(t, "-virtual-only", "-physical-only")
+	if err := validateFlags(); err == nil {
+		t.Error("-virtual-only and -physical-only were accepted together")
+	}
+}
+
+func TestDNSPresets(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"-dns-preset", "nordvpn"}, []string{"103.86.96.100"}},
+		{[]string{"-dns-preset", "cloudflare"}, []string{"1.1.1.1", "1.0.0.1"}},
+		{[]string{"-dns-preset", "Google"}, []string{"8.8.8.8", "8.8.4.4"}},
+		{[]string{"-dns-preset", "quad9"}, []string{"9.9.9.9"}},
+		{[]string{"-dns-preset", "cloudflare", "-dns", "10.0.0.53"}, []string{"10.0.0.53"}},
+	}
+	for _, tt := range tests {
+		setFlags(t, tt.args...)
+		if err := validateFlags(); err != nil {
+			t.Fatal(err)
+		}
+		if got := dnsList(); !slices.Equal(got, tt.want) {
+			t.Errorf("%v gives DNS %v, want %v", tt.args, got, tt.want)
+		}
+	}
+
+	setFlags(t, "-dns-preset", "opendns")
+	if err := validateFlags(); err == nil {
+		t.Error("unknown -dns-preset was accepted")
+	}
+}
+
+func TestWriteConfigStream(t *testing.T) {
+	setFlags(t, "-stdout")
+	servers := testServers(t, fixtureServers)
+	var out bytes.Buffer
+	if err := writeConfigStream(&out, "PRIV=", servers); err != nil {
+		t.Fatal(err)
+	}
+
+	var delimiters []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, "# === ") {
+			delimiters = append(delimiters, line)
+		}
+	}
+	want := []string{"# === Germany_1 ===", "# === Germany_2 ===", "# === Germany_3 ===", "# === France_1 ==="}
+	if !slices.Equal(delimiters, want) {
+		t.Errorf("delimiters = %q, want %q", delimiters, want)
+	}
+	if n := strings.Count(out.String(), "[Interface]\n"); n != len(servers) {
+		t.Errorf("stream holds %d configs, want %d", n, len(servers))
+	}
+	if !strings.HasPrefix(out.String(), want[0]+"\n"+buildConfig("PRIV=", servers[0])+want[1]+"\n") {
+		t.Errorf("first config isn't written whole between its delimiters:\n%s", out.String())
+	}
+}
+
+func TestWriteFailuresAreRecorded(t *testing.T) {
+	setFlags(t, "-no-geo")
+	quietRun(t)
+	old := writeFile
+	writeFile = func(name string, data []byte, perm os.FileMode) error {
+		if strings.Contains(name, "France") {
+			return errors.New("disk full")
+		}
+		return old(name, data, perm)
+	}
+	t.Cleanup(func() { writeFile = old })
+
+	dir := t.TempDir()
+	servers := selectServers(context.Background(), testServers(t, fixtureServers), false, 0, 0)
+	if _, err := generate(context.Background(), "PRIV=", servers, dir); err != nil {
+		t.Fatal(err)
+	}
+	if n := stats.failed.Load(); n != 2 {
+		t.Errorf("counted %d failed writes, want 2", n)
+	}
+	if n := stats.written.Load(); n != 5 {
+		t.Errorf("counted %d written configs, want 5", n)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "errors.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recorded []writeError
+	if err := json.Unmarshal(data, &recorded); err != nil {
+		t.Fatal(err)
+	}
+	want := []writeError{
+		{filepath.Join("best_configs", "France_Paris.conf"), "disk full"},
+		{filepath.Join("configs", "France", "Paris", "France_1.conf"), "disk full"},
+	}
+	if !slices.Equal(recorded, want) {
+		t.Errorf("errors.json = %v, want %v", recorded, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, progressFile)); err != nil {
+		t.Error("progress journal removed although writes failed")
+	}
+}
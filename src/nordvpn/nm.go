@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// configExt returns the file extension for the selected -format.
+func configExt() string {
+	if *format == "nm" {
+		return ".nmconnection"
+	}
+	return ".conf"
+}
+
+// renderConfig builds the server's config in the selected -format.
+func renderConfig(privateKey string, server Server) string {
+	if *format == "nm" {
+		return buildNMConfig(privateKey, server)
+	}
+	return buildConfig(privateKey, server)
+}
+
+// buildNMConfig returns a NetworkManager keyfile for the server, carrying
+// the same settings as buildConfig. Lists end in ";" as keyfiles expect.
+func buildNMConfig(privateKey string, server Server) string {
+	var v4, v6 []string
+	for _, cidr := range addressList() {
+		if ip, _, err := net.ParseCIDR(cidr); err == nil && ip.To4() != nil {
+			v4 = append(v4, cidr)
+		} else {
+			v6 = append(v6, cidr)
+		}
+	}
+	var route4, route6 bool
+	for _, cidr := range allowedIPList(server) {
+		if ip, _, err := net.ParseCIDR(cidr); err == nil && ip.To4() != nil {
+			route4 = true
+		} else {
+			route6 = true
+		}
+	}
+	var dns4, dns6, search []string
+	for _, entry := range dnsList() {
+		switch ip := net.ParseIP(entry); {
+		case ip == nil:
+			search = append(search, entry)
+		case ip.To4() != nil:
+			dns4 = append(dns4, entry)
+		default:
+			dns6 = append(dns6, entry)
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(configComments(server))
+	b.WriteString("[connection]\n")
+	b.WriteString("id=" + cleanServerName(server.Name) + "\n")
+	b.WriteString("type=wireguard\n")
+	b.WriteString("interface-name=" + mobileName(server) + "\n")
+	b.WriteString("\n[wireguard]\n")
+	b.WriteString("private-key=" + privateKey + "\n")
+	b.WriteString("\n[wireguard-peer." + findPublicKey(server) + "]\n")
+	b.WriteString("endpoint=" + endpointHost(server) + ":51820\n")
+	b.WriteString("allowed-ips=" + nmList(allowedIPList(server)) + "\n")
+	if *keepalive > 0 {
+		b.WriteString("persistent-keepalive=" + strconv.Itoa(*keepalive) + "\n")
+	}
+	writeNMIPSection(&b, "ipv4", v4, dns4, search, route4)
+	writeNMIPSection(&b, "ipv6", v6, dns6, nil, route6)
+	return b.String()
+}
+
+// writeNMIPSection writes an [ipv4] or [ipv6] section. Without an address
+// of that family it is disabled, unless AllowedIPs routes the family into
+// the tunnel: NetworkManager only installs those routes while the family
+// is enabled, so it is set to link-local, as wg-quick routes it too.
+func writeNMIPSection(b *strings.Builder, name string, addresses, dns, search []string, routed bool) {
+	b.WriteString("\n[" + name + "]\n")
+	if len(addresses) == 0 && !routed {
+		b.WriteString("method=disabled\n")
+		return
+	}
+	for i, cidr := range addresses {
+		b.WriteString("address" + strconv.Itoa(i+1) + "=" + cidr + "\n")
+	}
+	if len(dns) > 0 {
+		b.WriteString("dns=" + nmList(dns) + "\n")
+	}
+	if len(search) > 0 {
+		b.WriteString("dns-search=" + nmList(search) + "\n")
+	}
+	if len(addresses) == 0 {
+		b.WriteString("method=link-local\n")
+	} else {
+		b.WriteString("method=manual\n")
+	}
+}
+
+func nmList(entries []string) string {
+	return strings.Join(entries, ";") + ";"
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildNMConfig(t *testing.T) {
+	setFlags(t, "-dns", "103.86.96.100, 2400:bb40:4444::100")
+	servers := testServers(t, `[{"name":"Germany #1","hostname":"de1.nordvpn.com","station":"1.2.3.4",
+		"technologies":[{"identifier":"wireguard_udp","metadata":[{"name":"public_key","value":"PUB="}]}],
+		"locations":[{"country":{"name":"Germany","code":"DE","city":{"name":"Berlin"}}}]}]`)
+
+	want := `[connection]
+id=Germany_1
+type=wireguard
+interface-name=de-berlin
+
+[wireguard]
+private-key=PRIV=
+
+[wireguard-peer.PUB=]
+endpoint=1.2.3.4:51820
+allowed-ips=0.0.0.0/0;::/0;
+persistent-keepalive=25
+
+[ipv4]
+address1=10.5.0.2/16
+dns=103.86.96.100;
+method=manual
+
+[ipv6]
+dns=2400:bb40:4444::100;
+method=link-local
+`
+	if got := buildNMConfig("PRIV=", servers[0]); got != want {
+		t.Errorf("keyfile:\n%s\nwant:\n%s", got, want)
+	}
+
+	// Without IPv6 routes the family is switched off entirely
+	setFlags(t, "-allowed-ips", "10.0.0.0/8", "-dns", "103.86.96.100")
+	if got := buildNMConfig("PRIV=", servers[0]); !strings.HasSuffix(got, "[ipv6]\nmethod=disabled\n") {
+		t.Errorf("IPv6 not disabled without IPv6 AllowedIPs:\n%s", got)
+	}
+}
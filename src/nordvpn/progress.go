@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// startProgress prints "saved X/Y (Z%)" to w every 250ms, overwriting the
+// same line, until the returned stop function is called.
+func startProgress(w io.Writer, total int) (stop func()) {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	show := func() {
+		n := stats.written.Load() + stats.failed.Load() + stats.skipped.Load() + stats.duplicates.Load()
+		percent := 100
+		if total > 0 {
+			percent = int(n * 100 / int64(total))
+		}
+		fmt.Fprintf(w, "\r\033[Ksaved %d/%d (%d%%)", n, total, percent)
+	}
+
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(250 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				show()
+			case <-done:
+				show()
+				fmt.Fprintln(w)
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
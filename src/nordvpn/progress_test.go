@@ -0,0 +1,24 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestProgressReachesTotal(t *testing.T) {
+	stats = runStats{}
+	t.Cleanup(func() { stats = runStats{} })
+	var out bytes.Buffer
+	stop := startProgress(&out, 5)
+	stats.written.Add(2)
+	stats.failed.Add(1)
+	stats.skipped.Add(1)
+	stats.duplicates.Add(1)
+	stop()
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\r")
+	if last := lines[len(lines)-1]; last != "\033[Ksaved 5/5 (100%)" {
+		t.Errorf("last progress line = %q, want saved 5/5 (100%%)", last)
+	}
+}
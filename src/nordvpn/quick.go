@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// quickOutput is the file the "quick" subcommand writes to. It is nil when
+// generating the full set of configs.
+var quickOutput *string
+
+// saveQuick writes the config of the top-ranked server, the first after
+// sorting and filtering, to filename.
+func saveQuick(privateKey string, servers []Server, filename string) error {
+	if filename == "" {
+		filename = "nordvpn" + configExt()
+	}
+	server := servers[0]
+	if err := writeConfig(filename, renderConfig(privateKey, server)); err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		abs = filename
+	}
+	country := server.Locations[0].Country
+	fmt.Fprintf(status, "Saved %s (%s, %s, load %d%%) to %s\n", cleanServerName(server.Name), country.City.Name, country.Name, server.Load, abs)
+	return nil
+}
+
+// quickUsage explains the "quick" subcommand; every generation flag applies.
+func quickUsage() {
+	fmt.Fprintln(os.Stderr, "usage: quick [-output file] [flags]")
+	fmt.Fprintln(os.Stderr, "Writes a single config for the best server to ./nordvpn.conf.")
+	flag.PrintDefaults()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSaveQuick(t *testing.T) {
+	setFlags(t, "-no-geo")
+	quietRun(t)
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	servers := selectServers(context.Background(), testServers(t, fixtureServers), false, 0, 0)
+	if err := saveQuick("PRIV=", servers, ""); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "nordvpn.conf" {
+		t.Fatalf("quick wrote %v, want only nordvpn.conf", entries)
+	}
+	data, err := os.ReadFile("nordvpn.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "PublicKey = DE2=\n") {
+		t.Errorf("nordvpn.conf isn't the least loaded server's config:\n%s", data)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// lookupIP resolves a hostname; it is a variable so the resolver can be swapped.
+var lookupIP = net.DefaultResolver.LookupIP
+
+var (
+	resolvedMu  sync.Mutex
+	resolvedIPs = make(map[string]string)
+)
+
+// resolveEndpoints looks up the IPv4 address of every server's hostname for
+// -endpoint ip, -concurrency at a time. Servers whose hostname doesn't
+// resolve are dropped when drop is set and kept otherwise, falling back to
+// their station IP.
+func resolveEndpoints(ctx context.Context, servers []Server, drop bool) []Server {
+	ok := make([]bool, len(servers))
+	sem := make(chan struct{}, *concurrency)
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, hostname string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			lookupCtx, cancel := apiContext(ctx)
+			defer cancel()
+			ips, err := lookupIP(lookupCtx, "ip4", hostname)
+			if err != nil || len(ips) == 0 {
+				return
+			}
+			resolvedMu.Lock()
+			resolvedIPs[hostname] = ips[0].String()
+			resolvedMu.Unlock()
+			ok[i] = true
+		}(i, server.Hostname)
+	}
+	wg.Wait()
+
+	if !drop {
+		return servers
+	}
+	kept := servers[:0]
+	for i, server := range servers {
+		if ok[i] {
+			kept = append(kept, server)
+		}
+	}
+	return kept
+}
+
+// resolvedIP returns the address found by resolveEndpoints for hostname.
+func resolvedIP(hostname string) (string, bool) {
+	resolvedMu.Lock()
+	defer resolvedMu.Unlock()
+	ip, ok := resolvedIPs[hostname]
+	return ip, ok
+}
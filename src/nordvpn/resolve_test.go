@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestResolveEndpointsDropsUnresolved(t *testing.T) {
+	old := lookupIP
+	lookupIP = func(ctx context.Context, network, host string) ([]net.IP, error) {
+		if host == "gone.nordvpn.com" {
+			return nil, errors.New("no such host")
+		}
+		return []net.IP{net.ParseIP("192.0.2.1")}, nil
+	}
+	t.Cleanup(func() { lookupIP = old })
+	servers := testServers(t, `[{"name":"A","hostname":"a.nordvpn.com","station":"10.0.0.1"},
+		{"name":"Gone","hostname":"gone.nordvpn.com","station":"10.0.0.2"}]`)
+
+	kept := resolveEndpoints(context.Background(), servers, true)
+	if len(kept) != 1 || kept[0].Name != "A" {
+		t.Fatalf("kept %v, want only A", serverNames(kept))
+	}
+	setFlags(t, "-endpoint", "ip")
+	if host := endpointHost(kept[0]); host != "192.0.2.1" {
+		t.Errorf("endpoint = %q, want the resolved address", host)
+	}
+
+	servers = testServers(t, `[{"name":"A","hostname":"a.nordvpn.com","station":"10.0.0.1"},
+		{"name":"Gone","hostname":"gone.nordvpn.com","station":"10.0.0.2"}]`)
+	if kept := resolveEndpoints(context.Background(), servers, false); len(kept) != 2 {
+		t.Fatalf("without -require-resolvable kept %v, want both", serverNames(kept))
+	}
+	if host := endpointHost(servers[1]); host != "10.0.0.2" {
+		t.Errorf("unresolved endpoint = %q, want the station IP", host)
+	}
+}
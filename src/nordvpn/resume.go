@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// progressFile records the configs written so far, so an interrupted run
+// can be continued with -resume. It holds one JSON-encoded path per line.
+const progressFile = ".nordgen-progress.json"
+
+// progressJournal tracks written config paths, relative to the output directory.
+type progressJournal struct {
+	mu   sync.Mutex
+	f    *os.File
+	done map[string]bool
+}
+
+// journal is nil when no progress is being recorded.
+var journal *progressJournal
+
+// openJournal opens the progress journal at filename. With resume the
+// paths already listed are loaded, otherwise the journal starts empty.
+func openJournal(filename string, resume bool) (*progressJournal, error) {
+	j := &progressJournal{done: make(map[string]bool)}
+	if resume {
+		f, err := os.Open(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				var path string
+				if json.Unmarshal(scanner.Bytes(), &path) == nil {
+					j.done[path] = true
+				}
+			}
+			f.Close()
+		}
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if !resume {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(filename, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	j.f = f
+	return j, nil
+}
+
+func (j *progressJournal) isDone(path string) bool {
+	if j == nil {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.done[path]
+}
+
+func (j *progressJournal) add(path string) error {
+	if j == nil {
+		return nil
+	}
+	line, err := json.Marshal(path)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.done[path] = true
+	_, err = j.f.Write(append(line, '\n'))
+	return err
+}
+
+func (j *progressJournal) close() error {
+	if j == nil {
+		return nil
+	}
+	return j.f.Close()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResumeWritesOnlyMissingConfigs(t *testing.T) {
+	dir := t.TempDir()
+	setFlags(t, "-no-geo", "-resume", dir)
+	quietRun(t)
+
+	// The interrupted run got as far as one config
+	done := filepath.Join("configs", "Germany", "Berlin", "Germany_2.conf")
+	if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(done)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, done), []byte("first run"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	j, err := openJournal(filepath.Join(dir, progressFile), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j.add(done)
+	j.close()
+
+	servers := selectServers(context.Background(), testServers(t, fixtureServers), false, 0, 0)
+	if _, err := generate(context.Background(), "PRIV=", servers, dir); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, done)); string(data) != "first run" {
+		t.Errorf("config written by the interrupted run was written again: %q", data)
+	}
+	if n := stats.skipped.Load(); n != 1 {
+		t.Errorf("skipped %d configs, want 1", n)
+	}
+	// The other three configs and the three best configs were missing
+	if n := stats.written.Load(); n != 6 {
+		t.Errorf("wrote %d configs, want 6", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, progressFile)); !os.IsNotExist(err) {
+		t.Error("progress journal kept after the run finished")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// countryRoutes holds the -routes-file AllowedIPs by upper-case country code.
+// Countries without an entry use the global AllowedIPs.
+var countryRoutes map[string][]string
+
+// loadRoutes reads a JSON object mapping country codes to AllowedIPs lists,
+// e.g. {"US": ["10.0.0.0/8"], "de": ["0.0.0.0/0", "::/0"]}.
+func loadRoutes(filename string) (map[string][]string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading -routes-file: %w", err)
+	}
+	var raw map[string][]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid -routes-file %q: %w", filename, err)
+	}
+
+	routes := make(map[string][]string, len(raw))
+	for code, list := range raw {
+		if len(list) == 0 {
+			return nil, fmt.Errorf("invalid -routes-file %q: no routes for %q", filename, code)
+		}
+		for i, cidr := range list {
+			list[i] = strings.TrimSpace(cidr)
+			if _, _, err := net.ParseCIDR(list[i]); err != nil {
+				return nil, fmt.Errorf("invalid -routes-file %q: %q for %q is not a CIDR", filename, cidr, code)
+			}
+		}
+		routes[strings.ToUpper(code)] = list
+	}
+	return routes, nil
+}
+
+// serverRoutes returns the -routes-file entry for the server's country, if any.
+func serverRoutes(server Server) ([]string, bool) {
+	if countryRoutes == nil || len(server.Locations) == 0 {
+		return nil, false
+	}
+	list, ok := countryRoutes[strings.ToUpper(server.Locations[0].Country.Code)]
+	return list, ok
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCountryRoutes(t *testing.T) {
+	setFlags(t)
+	file := filepath.Join(t.TempDir(), "routes.json")
+	if err := os.WriteFile(file, []byte(`{"de": ["10.0.0.0/8", " 192.168.0.0/16 "]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	routes, err := loadRoutes(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	countryRoutes = routes
+	t.Cleanup(func() { countryRoutes = nil })
+
+	servers := testServers(t, fixtureServers)
+	if got := allowedIPList(servers[0]); !slices.Equal(got, []string{"10.0.0.0/8", "192.168.0.0/16"}) {
+		t.Errorf("AllowedIPs of a mapped country = %v", got)
+	}
+	if got := allowedIPList(servers[3]); !slices.Equal(got, []string{"0.0.0.0/0", "::/0"}) {
+		t.Errorf("AllowedIPs of an unmapped country = %v, want the default", got)
+	}
+
+	for _, bad := range []string{`{"de": []}`, `{"de": ["10.0.0.0"]}`, `["10.0.0.0/8"]`} {
+		if err := os.WriteFile(file, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadRoutes(file); err == nil {
+			t.Errorf("loadRoutes accepted %s", bad)
+		}
+	}
+}
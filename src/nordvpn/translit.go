@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// asciiFold maps accented Latin letters to their plain ASCII spelling.
+var asciiFold = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'ç': "c", 'ć': "c", 'č': "c",
+	'ď': "d", 'đ': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'ğ': "g",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'į': "i", 'ı': "i",
+	'ł': "l", 'ľ': "l",
+	'ñ': "n", 'ń': "n", 'ň': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ō': "o", 'ő': "o",
+	'ř': "r",
+	'ś': "s", 'š': "s", 'ş': "s", 'ș': "s",
+	'ť': "t", 'ţ': "t", 'ț': "t",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ū': "u", 'ů': "u", 'ű': "u", 'ų': "u",
+	'ý': "y", 'ÿ': "y",
+	'ź': "z", 'ż': "z", 'ž': "z",
+	'ß': "ss", 'æ': "ae", 'œ': "oe", 'þ': "th", 'ð': "d",
+}
+
+// transliterate spells name with ASCII letters, e.g. "São Paulo" becomes
+// "Sao Paulo". Characters it can't spell are dropped; a name left empty
+// that way (fully non-Latin) is returned unchanged.
+func transliterate(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if r < unicode.MaxASCII {
+			b.WriteRune(r)
+			continue
+		}
+		lower := unicode.ToLower(r)
+		plain, ok := asciiFold[lower]
+		if !ok && lower < unicode.MaxASCII {
+			plain, ok = string(lower), true // e.g. the Turkish dotted İ
+		}
+		if !ok {
+			continue
+		}
+		if unicode.IsUpper(r) {
+			plain = strings.ToUpper(plain[:1]) + plain[1:]
+		}
+		b.WriteString(plain)
+	}
+	if strings.TrimSpace(b.String()) == "" {
+		return name
+	}
+	return b.String()
+}
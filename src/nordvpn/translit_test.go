@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTransliterate(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"New York", "New York"},
+		{"São Paulo", "Sao Paulo"},
+		{"Bogotá", "Bogota"},
+		{"Zürich", "Zurich"},
+		{"Düsseldorf", "Dusseldorf"},
+		{"Straße", "Strasse"},
+		{"Łódź", "Lodz"},
+		{"Ærøskøbing", "Aeroskobing"},
+		{"Île-de-France", "Ile-de-France"},
+		{"İstanbul", "Istanbul"},
+		{"Москва", "Москва"},   // nothing left in ASCII, kept as is
+		{"Tōkyō 東京", "Tokyo "}, // the Latin part is enough
+	}
+	for _, tt := range tests {
+		if got := transliterate(tt.name); got != tt.want {
+			t.Errorf("transliterate(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLocationNames(t *testing.T) {
+	servers, err := decodeServers(strings.NewReader(`[{"locations":[{"country":{"name":"Côte d'Ivoire","city":{"name":"São Paulo-Sul"}}}]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	country, city := locationNames(servers[0])
+	if country != "Cote_d'Ivoire" || city != "Sao_PauloSul" {
+		t.Errorf("locationNames = %q, %q", country, city)
+	}
+}